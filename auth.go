@@ -0,0 +1,144 @@
+package traefik_geoblock_plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Credentials for outbound requests and their redaction from logs
+
+// tokenPlaceholder is replaced by the configured token in URLs and header values
+const tokenPlaceholder = "{token}"
+
+// redacted replaces credentials in logged URLs
+const redacted = "REDACTED"
+
+// sensitiveQueryParams are query parameter name fragments whose values are redacted
+var sensitiveQueryParams = []string{"token", "key", "secret", "password", "auth", "signature"}
+
+// requestAuth holds the headers and token sent with outbound requests
+type requestAuth struct {
+	headers map[string]string // values may contain {token}
+	token   string
+}
+
+// newRequestAuth loads the token from tokenFile or tokenEnv (at most one may be
+// set) and checks that every {token} placeholder in urls and headers can be filled
+func newRequestAuth(headers map[string]string, tokenFile, tokenEnv string, urls ...string) (requestAuth, error) {
+	auth := requestAuth{headers: headers}
+
+	switch {
+	case tokenFile != "" && tokenEnv != "":
+		return auth, errors.New("only one of tokenFile and tokenEnv may be set")
+	case tokenFile != "":
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return auth, fmt.Errorf("failed to read token file: %w", err)
+		}
+		auth.token = strings.TrimSpace(string(data))
+		if auth.token == "" {
+			return auth, fmt.Errorf("token file %s is empty", tokenFile)
+		}
+	case tokenEnv != "":
+		auth.token = strings.TrimSpace(os.Getenv(tokenEnv))
+		if auth.token == "" {
+			return auth, fmt.Errorf("environment variable %s is not set", tokenEnv)
+		}
+	}
+
+	if auth.token == "" {
+		usesToken := false
+		for _, rawURL := range urls {
+			usesToken = usesToken || strings.Contains(rawURL, tokenPlaceholder)
+		}
+		for _, value := range headers {
+			usesToken = usesToken || strings.Contains(value, tokenPlaceholder)
+		}
+		if usesToken {
+			return auth, errors.New("{token} is used but no tokenFile or tokenEnv is set")
+		}
+	}
+
+	return auth, nil
+}
+
+// newRequest creates a GET request for rawURL with the token and headers applied
+func (a requestAuth) newRequest(ctx context.Context, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.expand(rawURL), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", a.redactError(err))
+	}
+
+	for name, value := range a.headers {
+		req.Header.Set(name, a.expand(value))
+	}
+
+	return req, nil
+}
+
+func (a requestAuth) expand(s string) string {
+	if a.token == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, tokenPlaceholder, a.token)
+}
+
+// redactURL removes credentials from rawURL for logging, including the token
+// wherever it was substituted
+func (a requestAuth) redactURL(rawURL string) string {
+	rawURL = redactURL(rawURL)
+	if a.token != "" {
+		rawURL = strings.ReplaceAll(rawURL, a.token, redacted)
+		rawURL = strings.ReplaceAll(rawURL, url.QueryEscape(a.token), redacted)
+	}
+	return rawURL
+}
+
+// redactError removes credentials from the URL that net/http includes in its errors
+func (a requestAuth) redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = a.redactURL(urlErr.URL)
+	}
+	return err
+}
+
+// redactURL hides the password of rawURL and the values of query parameters
+// that look like credentials (token, apiKey, license_key, ...)
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		// Never echo something we cannot reason about
+		return redacted
+	}
+
+	if parsed.User != nil {
+		if _, hasPassword := parsed.User.Password(); hasPassword {
+			parsed.User = url.UserPassword(parsed.User.Username(), redacted)
+		} else {
+			parsed.User = url.User(redacted)
+		}
+	}
+
+	if parsed.RawQuery != "" {
+		query := parsed.Query()
+		for name := range query {
+			lower := strings.ToLower(name)
+			for _, fragment := range sensitiveQueryParams {
+				if strings.Contains(lower, fragment) {
+					query.Set(name, redacted)
+					break
+				}
+			}
+		}
+		parsed.RawQuery = query.Encode()
+	}
+
+	// Keep placeholders such as {ip} and {token} readable
+	return strings.NewReplacer("%7B", "{", "%7D", "}").Replace(parsed.String())
+}
@@ -0,0 +1,166 @@
+package traefik_geoblock_plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limiting and circuit breaking for remote providers
+
+const (
+	// defaultBreakerThreshold is the number of consecutive failures that opens a breaker
+	defaultBreakerThreshold = 5
+	// defaultBreakerCooldown is how long an open breaker rejects lookups before probing
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// Circuit breaker states, as exported by the state gauge
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var (
+	errRateLimited = errors.New("rate limit exceeded")
+	errCircuitOpen = errors.New("circuit breaker open")
+)
+
+// tokenBucket allows rate lookups per second on average with bursts of up to
+// burst, by default one minute's quota
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(perMinute, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &tokenBucket{
+		rate:   float64(perMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// circuitBreaker stops calling a provider after threshold consecutive failures.
+// Once cooldown has passed a single probe is let through (half-open): success
+// closes the breaker, failure opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a lookup may be attempted
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		// Only one probe at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record reports the outcome of an allowed lookup
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if success {
+		if b.state != breakerClosed {
+			fmt.Printf("[GeoBlock] Circuit breaker for provider %s closed\n", b.name)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state == breakerClosed {
+			fmt.Printf("[GeoBlock] Circuit breaker for provider %s opened after %d consecutive failures\n", b.name, b.failures)
+		}
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+func (b *circuitBreaker) currentState() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// renderBreakerStates renders the circuit breaker state gauge of every provider that has one
+func (g *GeoBlock) renderBreakerStates() string {
+	var buf strings.Builder
+
+	buf.WriteString("# HELP traefik_geoblock_circuit_breaker_state Circuit breaker state per provider (0 closed, 1 open, 2 half-open)\n")
+	buf.WriteString("# TYPE traefik_geoblock_circuit_breaker_state gauge\n")
+	for i := range g.providers {
+		if breaker := g.providers[i].breaker; breaker != nil {
+			buf.WriteString(fmt.Sprintf("traefik_geoblock_circuit_breaker_state{provider=\"%s\"} %d\n",
+				escapePrometheusLabel(g.providers[i].name), breaker.currentState()))
+		}
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,183 @@
+package traefik_geoblock_plugin
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced time source
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	bucket := newTokenBucket(60, 2)
+	bucket.now = clock.Now
+
+	if !bucket.allow() || !bucket.allow() {
+		t.Fatal("Expected the burst to be available")
+	}
+	if bucket.allow() {
+		t.Error("Expected the bucket to be empty after the burst")
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if !bucket.allow() {
+		t.Error("Expected one token after a second at 60/min")
+	}
+	if bucket.allow() {
+		t.Error("Expected a single token to have been refilled")
+	}
+
+	// Refills never exceed the burst
+	clock.now = clock.now.Add(time.Hour)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if bucket.allow() {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Expected refill to be capped at the burst of 2, got %d", allowed)
+	}
+}
+
+func TestTokenBucketDefaultBurst(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	bucket := newTokenBucket(45, 0)
+	bucket.now = clock.Now
+
+	// Concurrent misses may use one minute's quota at once
+	for i := 0; i < 45; i++ {
+		if !bucket.allow() {
+			t.Fatalf("Expected lookup %d to be within the default burst", i+1)
+		}
+	}
+	if bucket.allow() {
+		t.Error("Expected the bucket to be empty after one minute's quota")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	breaker := newCircuitBreaker("test", 3, time.Minute)
+	breaker.now = clock.Now
+
+	for i := 0; i < 3; i++ {
+		if !breaker.allow() {
+			t.Fatalf("Expected closed breaker to allow lookup %d", i)
+		}
+		breaker.record(false)
+	}
+	if breaker.currentState() != breakerOpen || breaker.allow() {
+		t.Fatal("Expected breaker to open after 3 consecutive failures")
+	}
+
+	// After the cooldown a single probe goes through
+	clock.now = clock.now.Add(time.Minute)
+	if !breaker.allow() {
+		t.Fatal("Expected a probe after the cooldown")
+	}
+	if breaker.currentState() != breakerHalfOpen || breaker.allow() {
+		t.Fatal("Expected only one probe while half-open")
+	}
+
+	// A failed probe reopens the breaker for another cooldown
+	breaker.record(false)
+	if breaker.currentState() != breakerOpen || breaker.allow() {
+		t.Fatal("Expected failed probe to reopen the breaker")
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	if !breaker.allow() {
+		t.Fatal("Expected a probe after the second cooldown")
+	}
+	breaker.record(true)
+	if breaker.currentState() != breakerClosed {
+		t.Fatal("Expected successful probe to close the breaker")
+	}
+
+	// Successes reset the failure count
+	breaker.record(false)
+	breaker.record(false)
+	breaker.record(true)
+	breaker.record(false)
+	if breaker.currentState() != breakerClosed {
+		t.Error("Expected non-consecutive failures to keep the breaker closed")
+	}
+}
+
+func TestProviderCircuitBreakerShortCircuits(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		rw.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	geoBlock := newProviderTestGeoBlock(t, []ProviderConfig{{
+		Name:             "ipapi",
+		Type:             ProviderHTTPJSON,
+		URL:              server.URL + "/{ip}",
+		BreakerThreshold: 2,
+		BreakerCooldown:  "1h",
+	}})
+
+	for _, ip := range []string{"1.1.1.1", "1.1.1.2", "1.1.1.3", "1.1.1.4"} {
+		if _, err := geoBlock.getGeoInfo(ip); err == nil {
+			t.Fatalf("Expected lookup of %s to fail", ip)
+		}
+	}
+
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("Expected the open breaker to stop upstream calls after 2 failures, got %d calls", got)
+	}
+	if _, err := geoBlock.getGeoInfo("1.1.1.5"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected circuit breaker error, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	geoBlock.servePrometheusMetrics(rec)
+	if !strings.Contains(rec.Body.String(), `traefik_geoblock_circuit_breaker_state{provider="ipapi"} 1`) {
+		t.Errorf("Expected open breaker gauge, got:\n%s", rec.Body.String())
+	}
+}
+
+func TestProviderRateLimit(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = rw.Write([]byte(`{"country_code":"US"}`))
+	}))
+	defer server.Close()
+
+	geoBlock := newProviderTestGeoBlock(t, []ProviderConfig{
+		{Type: ProviderHTTPJSON, URL: server.URL + "/{ip}", RateLimit: 1, RateBurst: 2},
+	})
+
+	for _, ip := range []string{"1.1.1.1", "1.1.1.2"} {
+		if info, err := geoBlock.getGeoInfo(ip); err != nil || info.Country != "US" {
+			t.Fatalf("Expected lookup of %s within the burst to succeed, got %+v (%v)", ip, info, err)
+		}
+	}
+	if _, err := geoBlock.getGeoInfo("1.1.1.3"); !errors.Is(err, errRateLimited) {
+		t.Errorf("Expected rate limit error, got %v", err)
+	}
+	if _, ok := geoBlock.cache.findAddress(net.ParseIP("1.1.1.3")); ok {
+		t.Error("Expected the rate limit rejection not to be cached")
+	}
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("Expected 2 upstream calls, got %d", got)
+	}
+}
@@ -0,0 +1,589 @@
+package traefik_geoblock_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultCacheMaxEntries bounds the cache when cacheMaxEntries is not set
+	defaultCacheMaxEntries = 100000
+	// cacheShardCount is the number of independently locked cache shards
+	cacheShardCount = 16
+	// cacheSnapshotVersion is the format version of cachePersistPath files
+	cacheSnapshotVersion = 1
+)
+
+// cacheSnapshot is the on-disk form of the cache. Entries are listed most
+// recently used first within each shard; failed lookups are not persisted.
+type cacheSnapshot struct {
+	Version int                  `json:"version"`
+	Entries []cacheSnapshotEntry `json:"entries"`
+}
+
+type cacheSnapshotEntry struct {
+	Key        string    `json:"key"`
+	Info       geoInfo   `json:"info"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	StaleUntil time.Time `json:"staleUntil"`
+}
+
+// geoCache is a bounded LRU cache of lookup results. Keys are spread over
+// shards with their own lock and LRU list, so concurrent requests rarely
+// contend; when a shard is full its least recently used entry is evicted. The
+// shard capacities add up to the configured maximum exactly.
+//
+// Addresses are cached on their own unless prefix caching is enabled: then an
+// answer is stored once for its whole network (the configured prefix, or the
+// network the provider matched) and lookups probe every prefix length in use.
+//
+// Failed lookups are cached too (negative entries), and with a stale duration
+// expired answers keep being served while a single caller refreshes them.
+type geoCache struct {
+	hits          uint64 // counters first: 64-bit atomics must be aligned on 32-bit platforms
+	misses        uint64
+	evictions     uint64
+	staleHits     uint64
+	lengths       [2]prefixLengths // IPv4, IPv6
+	v4Prefix      int
+	v6Prefix      int
+	staleDuration time.Duration
+	shardCount    uint32 // shards in use, fewer than cacheShardCount for tiny caches
+	shards        [cacheShardCount]cacheShard
+}
+
+// prefixLengths is the set of prefix lengths (0-128) that have cache entries
+type prefixLengths [3]uint64
+
+type cacheShard struct {
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	head     *cacheEntry // most recently used
+	tail     *cacheEntry // least recently used
+	capacity int
+}
+
+type cacheEntry struct {
+	key        string
+	info       geoInfo
+	err        error // failed lookup, cached for the negative duration
+	expiresAt  time.Time
+	staleUntil time.Time // an expired answer is served until then while it is refreshed
+	refreshing bool      // a refresh of the expired answer is running
+	retryAt    time.Time // earliest refresh after a failed one
+	prev       *cacheEntry
+	next       *cacheEntry
+}
+
+// cacheHit is a cached answer or failure
+type cacheHit struct {
+	key     string
+	info    geoInfo
+	err     error
+	stale   bool // expired, served while it is refreshed
+	refresh bool // the caller claimed the refresh of the stale answer and must run it
+}
+
+// newGeoCache creates a cache holding at most maxEntries results
+func newGeoCache(maxEntries int) *geoCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+
+	c := &geoCache{shardCount: cacheShardCount}
+	if maxEntries < cacheShardCount {
+		c.shardCount = uint32(maxEntries)
+	}
+	// Spread the remainder so the capacities add up to maxEntries
+	capacity, remainder := maxEntries/int(c.shardCount), maxEntries%int(c.shardCount)
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]*cacheEntry)
+		if i < int(c.shardCount) {
+			c.shards[i].capacity = capacity
+			if i < remainder {
+				c.shards[i].capacity++
+			}
+		}
+	}
+	return c
+}
+
+// shard picks the shard of key (FNV-1a)
+func (c *geoCache) shard(key string) *cacheShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &c.shards[hash%c.shardCount]
+}
+
+// setPrefixLengths enables prefix caching; 0 keeps caching addresses of that family on their own
+func (c *geoCache) setPrefixLengths(v4Prefix, v6Prefix int) {
+	c.v4Prefix, c.v6Prefix = v4Prefix, v6Prefix
+}
+
+// setStaleDuration lets expired answers be served for up to stale while they are refreshed
+func (c *geoCache) setStaleDuration(stale time.Duration) {
+	c.staleDuration = stale
+}
+
+// result returns the cached answer, or the cached failure
+func (h *cacheHit) result() (*geoInfo, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+	info := h.info
+	return &info, nil
+}
+
+// getAddress returns the entry covering ip and counts the hit or miss. When the
+// entry is stale and nobody is refreshing it yet, the caller is told to.
+func (c *geoCache) getAddress(ip net.IP) (cacheHit, bool) {
+	hit, ok := c.lookupAddress(ip, true)
+	c.count(ok)
+	if hit.stale {
+		atomic.AddUint64(&c.staleHits, 1)
+	}
+	return hit, ok
+}
+
+// findAddress is getAddress without counting or refreshing, for rechecks of a miss
+func (c *geoCache) findAddress(ip net.IP) (cacheHit, bool) {
+	return c.lookupAddress(ip, false)
+}
+
+func (c *geoCache) count(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+// lookupAddress looks up the entry covering ip, most specific network first
+func (c *geoCache) lookupAddress(ip net.IP, claim bool) (cacheHit, bool) {
+	if c.v4Prefix == 0 && c.v6Prefix == 0 {
+		return c.lookup(ip.String(), claim)
+	}
+
+	family, bits := addressFamily(ip)
+	for ones := bits; ones >= 0; ones-- {
+		if !c.lengths[family].has(ones) {
+			continue
+		}
+		if hit, ok := c.lookup(networkKey(ip, ones, bits), claim); ok {
+			return hit, true
+		}
+	}
+	return cacheHit{}, false
+}
+
+// lookup returns the live or stale entry under key; claim marks a stale entry
+// as being refreshed by the caller
+func (c *geoCache) lookup(key string, claim bool) (cacheHit, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.entries[key]
+	if !exists {
+		return cacheHit{}, false
+	}
+
+	hit := cacheHit{key: key, info: entry.info, err: entry.err}
+	if now := time.Now(); now.After(entry.expiresAt) {
+		if !now.Before(entry.staleUntil) {
+			s.remove(entry)
+			return cacheHit{}, false
+		}
+		hit.stale = true
+		if claim && !entry.refreshing && !now.Before(entry.retryAt) {
+			entry.refreshing = true
+			hit.refresh = true
+		}
+	}
+
+	s.moveToFront(entry)
+	return hit, true
+}
+
+// setAddress caches info for the network of ip it applies to and returns the key used
+func (c *geoCache) setAddress(ip net.IP, info *geoInfo, duration time.Duration) string {
+	key := c.addressKey(ip, info.network)
+	c.set(key, info, duration)
+	return key
+}
+
+// setAddressError caches a failed lookup of ip; it is not served stale
+func (c *geoCache) setAddressError(ip net.IP, err error, duration time.Duration) {
+	c.put(c.addressKey(ip, nil), cacheEntry{err: err, expiresAt: time.Now().Add(duration)})
+}
+
+// addressKey returns the key of the network of ip an answer applies to: the
+// network matched by the provider, else the configured prefix, else ip itself
+func (c *geoCache) addressKey(ip net.IP, network *net.IPNet) string {
+	if c.v4Prefix == 0 && c.v6Prefix == 0 {
+		return ip.String()
+	}
+
+	family, bits := addressFamily(ip)
+	ones := bits
+	prefix := c.v4Prefix
+	if family == 1 {
+		prefix = c.v6Prefix
+	}
+	if prefix > 0 {
+		ones = prefix
+	}
+	if network != nil && network.Contains(ip) {
+		if networkOnes, networkBits := network.Mask.Size(); networkBits == bits {
+			ones = networkOnes
+		}
+	}
+
+	c.lengths[family].add(ones)
+	return networkKey(ip, ones, bits)
+}
+
+// setOrganization updates the organization of a cached answer
+func (c *geoCache) setOrganization(key, organization string) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, exists := s.entries[key]; exists && entry.err == nil {
+		entry.info.Organization = organization
+	}
+}
+
+// refreshFailed keeps serving the stale entry under key and allows the next
+// refresh after retryAfter
+func (c *geoCache) refreshFailed(key string, retryAfter time.Duration) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, exists := s.entries[key]; exists {
+		entry.refreshing = false
+		entry.retryAt = time.Now().Add(retryAfter)
+	}
+}
+
+func (c *geoCache) set(key string, info *geoInfo, duration time.Duration) {
+	expiresAt := time.Now().Add(duration)
+	c.put(key, cacheEntry{info: *info, expiresAt: expiresAt, staleUntil: expiresAt.Add(c.staleDuration)})
+}
+
+// put stores value under key, replacing any previous entry
+func (c *geoCache) put(key string, value cacheEntry) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, exists := s.entries[key]; exists {
+		value.prev, value.next = entry.prev, entry.next
+		value.key = key
+		*entry = value
+		s.moveToFront(entry)
+		return
+	}
+
+	entry := &value
+	entry.key = key
+	s.entries[key] = entry
+	s.pushFront(entry)
+
+	for len(s.entries) > s.capacity {
+		s.remove(s.tail)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// save writes the live and stale answers to path, replacing it atomically
+func (c *geoCache) save(path string) (int, error) {
+	snapshot := cacheSnapshot{Version: cacheSnapshotVersion, Entries: []cacheSnapshotEntry{}}
+	now := time.Now()
+
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for entry := s.head; entry != nil; entry = entry.next {
+			if entry.err != nil || !now.Before(entry.staleUntil) {
+				continue
+			}
+			snapshot.Entries = append(snapshot.Entries, cacheSnapshotEntry{
+				Key:        entry.key,
+				Info:       entry.info,
+				ExpiresAt:  entry.expiresAt,
+				StaleUntil: entry.staleUntil,
+			})
+		}
+		s.mu.Unlock()
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode cache snapshot: %w", err)
+	}
+	staged, err := stageDatabaseFile(path, bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err := os.Rename(staged, path); err != nil {
+		os.Remove(staged)
+		return 0, fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+
+	return len(snapshot.Entries), nil
+}
+
+// load restores the entries saved at path with their original expiry. Entries
+// past their stale window, or keyed for another prefix caching setting, are
+// skipped. A missing file is not an error.
+func (c *geoCache) load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, fmt.Errorf("failed to decode cache snapshot: %w", err)
+	}
+	if snapshot.Version != cacheSnapshotVersion {
+		return 0, fmt.Errorf("unsupported cache snapshot version %d", snapshot.Version)
+	}
+
+	now, loaded := time.Now(), 0
+	// Oldest first, so the most recently used entries end up in front
+	for i := len(snapshot.Entries) - 1; i >= 0; i-- {
+		saved := snapshot.Entries[i]
+		if !now.Before(saved.StaleUntil) || !c.restoreKey(saved.Key) {
+			continue
+		}
+		c.put(saved.Key, cacheEntry{info: saved.Info, expiresAt: saved.ExpiresAt, staleUntil: saved.StaleUntil})
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+// restoreKey reports whether a saved key can be looked up with the current
+// prefix caching setting, registering its prefix length
+func (c *geoCache) restoreKey(key string) bool {
+	if !strings.Contains(key, "/") {
+		ip := net.ParseIP(key)
+		if ip == nil {
+			return false
+		}
+		if c.v4Prefix != 0 || c.v6Prefix != 0 {
+			family, bits := addressFamily(ip)
+			c.lengths[family].add(bits)
+		}
+		return true
+	}
+
+	if c.v4Prefix == 0 && c.v6Prefix == 0 {
+		return false
+	}
+	ip, network, err := net.ParseCIDR(key)
+	if err != nil {
+		return false
+	}
+	ones, bits := network.Mask.Size()
+	if networkKey(ip, ones, bits) != key {
+		return false
+	}
+	family, _ := addressFamily(ip)
+	c.lengths[family].add(ones)
+	return true
+}
+
+// persist saves the cache to path every interval and once more when ctx is done
+func (c *geoCache) persist(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.save(path); err != nil {
+				fmt.Printf("[GeoBlock] Warning: Failed to persist cache: %v\n", err)
+			}
+		case <-ctx.Done():
+			// Final snapshot before shutdown
+			if count, err := c.save(path); err != nil {
+				fmt.Printf("[GeoBlock] Warning: Failed to persist cache: %v\n", err)
+			} else {
+				fmt.Printf("[GeoBlock] Saved %d cache entries to %s\n", count, path)
+			}
+			return
+		}
+	}
+}
+
+// size returns the number of cached entries, including expired ones not yet removed
+func (c *geoCache) size() int {
+	total := 0
+	for i := range c.shards {
+		c.shards[i].mu.Lock()
+		total += len(c.shards[i].entries)
+		c.shards[i].mu.Unlock()
+	}
+	return total
+}
+
+// cacheOptions are the parsed cache durations of the configuration
+type cacheOptions struct {
+	negativeDuration time.Duration // how long failures and UNKNOWN answers are cached
+	staleDuration    time.Duration // how long expired answers are still served
+	persistInterval  time.Duration // how often the cache is saved to cachePersistPath
+}
+
+// parseCacheOptions validates the cache options, filling in their defaults
+func parseCacheOptions(config *Config) (cacheOptions, error) {
+	options := cacheOptions{persistInterval: 5 * time.Minute}
+
+	if config.CacheDuration <= 0 {
+		config.CacheDuration = 60
+	}
+	if config.CacheIPv4Prefix < 0 || config.CacheIPv4Prefix > 32 {
+		return options, fmt.Errorf("invalid cacheIPv4Prefix %d", config.CacheIPv4Prefix)
+	}
+	if config.CacheIPv6Prefix < 0 || config.CacheIPv6Prefix > 128 {
+		return options, fmt.Errorf("invalid cacheIPv6Prefix %d", config.CacheIPv6Prefix)
+	}
+
+	var err error
+	if options.negativeDuration, err = parseCacheDuration("cacheNegativeDuration", config.CacheNegativeDuration); err != nil {
+		return options, err
+	}
+	if options.staleDuration, err = parseCacheDuration("cacheStaleDuration", config.CacheStaleDuration); err != nil {
+		return options, err
+	}
+	if config.CachePersistInterval != "" {
+		if options.persistInterval, err = time.ParseDuration(config.CachePersistInterval); err != nil || options.persistInterval <= 0 {
+			return options, fmt.Errorf("invalid cachePersistInterval %q", config.CachePersistInterval)
+		}
+	}
+	return options, nil
+}
+
+// parseCacheDuration parses an optional, non-negative duration option
+func parseCacheDuration(option, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid %s %q", option, value)
+	}
+	return duration, nil
+}
+
+// addressFamily returns the index (0 for IPv4, 1 for IPv6) and bit length of ip's family
+func addressFamily(ip net.IP) (int, int) {
+	if ip.To4() != nil {
+		return 0, 32
+	}
+	return 1, 128
+}
+
+// networkKey is the cache key of the /ones network containing ip. Full-length
+// prefixes are keyed by the bare address.
+func networkKey(ip net.IP, ones, bits int) string {
+	if ones == bits {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(ones, bits)).String() + "/" + strconv.Itoa(ones)
+}
+
+func (p *prefixLengths) has(ones int) bool {
+	return atomic.LoadUint64(&p[ones/64])&(1<<uint(ones%64)) != 0
+}
+
+func (p *prefixLengths) add(ones int) {
+	word, bit := &p[ones/64], uint64(1)<<uint(ones%64)
+	for {
+		old := atomic.LoadUint64(word)
+		if old&bit != 0 || atomic.CompareAndSwapUint64(word, old, old|bit) {
+			return
+		}
+	}
+}
+
+func (s *cacheShard) pushFront(entry *cacheEntry) {
+	entry.prev = nil
+	entry.next = s.head
+	if s.head != nil {
+		s.head.prev = entry
+	}
+	s.head = entry
+	if s.tail == nil {
+		s.tail = entry
+	}
+}
+
+func (s *cacheShard) unlink(entry *cacheEntry) {
+	if entry.prev != nil {
+		entry.prev.next = entry.next
+	} else {
+		s.head = entry.next
+	}
+	if entry.next != nil {
+		entry.next.prev = entry.prev
+	} else {
+		s.tail = entry.prev
+	}
+	entry.prev, entry.next = nil, nil
+}
+
+func (s *cacheShard) moveToFront(entry *cacheEntry) {
+	if s.head == entry {
+		return
+	}
+	s.unlink(entry)
+	s.pushFront(entry)
+}
+
+func (s *cacheShard) remove(entry *cacheEntry) {
+	s.unlink(entry)
+	delete(s.entries, entry.key)
+}
+
+// render renders the cache counters in the Prometheus text format
+func (c *geoCache) render() string {
+	var buf strings.Builder
+
+	buf.WriteString("# HELP traefik_geoblock_cache_hits_total Lookups answered from the cache\n")
+	buf.WriteString("# TYPE traefik_geoblock_cache_hits_total counter\n")
+	buf.WriteString(fmt.Sprintf("traefik_geoblock_cache_hits_total %d\n", atomic.LoadUint64(&c.hits)))
+	buf.WriteString("# HELP traefik_geoblock_cache_misses_total Lookups not found in the cache\n")
+	buf.WriteString("# TYPE traefik_geoblock_cache_misses_total counter\n")
+	buf.WriteString(fmt.Sprintf("traefik_geoblock_cache_misses_total %d\n", atomic.LoadUint64(&c.misses)))
+	buf.WriteString("# HELP traefik_geoblock_cache_stale_hits_total Expired answers served while they were refreshed\n")
+	buf.WriteString("# TYPE traefik_geoblock_cache_stale_hits_total counter\n")
+	buf.WriteString(fmt.Sprintf("traefik_geoblock_cache_stale_hits_total %d\n", atomic.LoadUint64(&c.staleHits)))
+	buf.WriteString("# HELP traefik_geoblock_cache_evictions_total Entries evicted because the cache was full\n")
+	buf.WriteString("# TYPE traefik_geoblock_cache_evictions_total counter\n")
+	buf.WriteString(fmt.Sprintf("traefik_geoblock_cache_evictions_total %d\n", atomic.LoadUint64(&c.evictions)))
+	buf.WriteString("# HELP traefik_geoblock_cache_entries Entries currently in the cache\n")
+	buf.WriteString("# TYPE traefik_geoblock_cache_entries gauge\n")
+	buf.WriteString(fmt.Sprintf("traefik_geoblock_cache_entries %d\n", c.size()))
+
+	return buf.String()
+}
@@ -0,0 +1,618 @@
+package traefik_geoblock_plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cachedInfo returns the fresh answer cached for ip, counting the hit or miss
+func cachedInfo(c *geoCache, ip string) *geoInfo {
+	hit, ok := c.getAddress(net.ParseIP(ip))
+	if !ok || hit.stale || hit.err != nil {
+		return nil
+	}
+	return &hit.info
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	// 16 entries over 16 shards: one entry per shard
+	cache := newGeoCache(cacheShardCount)
+
+	// Find two keys that share a shard
+	first := "10.0.0.0"
+	var second string
+	for i := 1; second == ""; i++ {
+		if key := fmt.Sprintf("10.0.0.%d", i); cache.shard(key) == cache.shard(first) {
+			second = key
+		}
+	}
+
+	cache.set(first, &geoInfo{Country: "US"}, time.Hour)
+	cache.set(second, &geoInfo{Country: "DE"}, time.Hour)
+
+	if cachedInfo(cache, first) != nil {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	if info := cachedInfo(cache, second); info == nil || info.Country != "DE" {
+		t.Errorf("Expected DE, got %+v", info)
+	}
+	if cache.evictions != 1 {
+		t.Errorf("Expected 1 eviction, got %d", cache.evictions)
+	}
+}
+
+func TestCacheLRUOrder(t *testing.T) {
+	cache := newGeoCache(3 * cacheShardCount)
+
+	var keys []string
+	target := cache.shard("192.0.2.0")
+	for i := 0; len(keys) < 4; i++ {
+		if key := fmt.Sprintf("192.0.2.%d", i); cache.shard(key) == target {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys[:3] {
+		cache.set(key, &geoInfo{Country: "US"}, time.Hour)
+	}
+	// Reading the oldest entry makes the second one the least recently used
+	if cachedInfo(cache, keys[0]) == nil {
+		t.Fatal("Expected the first entry to be cached")
+	}
+	cache.set(keys[3], &geoInfo{Country: "US"}, time.Hour)
+
+	if cachedInfo(cache, keys[1]) != nil {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	for _, key := range []string{keys[0], keys[2], keys[3]} {
+		if cachedInfo(cache, key) == nil {
+			t.Errorf("Expected %s to be cached", key)
+		}
+	}
+}
+
+func TestCacheBounded(t *testing.T) {
+	cache := newGeoCache(100)
+
+	for i := 0; i < 10000; i++ {
+		cache.set(fmt.Sprintf("10.%d.%d.1", i/256, i%256), &geoInfo{Country: "US"}, time.Hour)
+	}
+
+	if size := cache.size(); size > 100 {
+		t.Errorf("Expected at most 100 entries, got %d", size)
+	}
+	if cache.evictions == 0 {
+		t.Error("Expected evictions")
+	}
+
+	// Caches smaller than the shard count are bounded too
+	for _, maxEntries := range []int{1, 5, cacheShardCount + 1} {
+		cache := newGeoCache(maxEntries)
+		for i := 0; i < 1000; i++ {
+			cache.set(fmt.Sprintf("10.0.%d.%d", i/256, i%256), &geoInfo{Country: "US"}, time.Hour)
+		}
+		if size := cache.size(); size != maxEntries {
+			t.Errorf("Expected %d entries, got %d", maxEntries, size)
+		}
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	cache := newGeoCache(100)
+
+	cache.set("1.1.1.1", &geoInfo{Country: "US"}, -time.Second)
+	if cachedInfo(cache, "1.1.1.1") != nil {
+		t.Error("Expected expired entry to be ignored")
+	}
+	if cache.size() != 0 {
+		t.Errorf("Expected expired entry to be removed, got %d entries", cache.size())
+	}
+
+	// Updating an entry refreshes its expiry
+	cache.set("1.1.1.1", &geoInfo{Country: "US"}, -time.Second)
+	cache.set("1.1.1.1", &geoInfo{Country: "DE"}, time.Hour)
+	if info := cachedInfo(cache, "1.1.1.1"); info == nil || info.Country != "DE" {
+		t.Errorf("Expected DE, got %+v", info)
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	cache := newGeoCache(100)
+
+	cache.set("1.1.1.1", &geoInfo{Country: "US"}, time.Hour)
+	cachedInfo(cache, "1.1.1.1")
+	cachedInfo(cache, "1.1.1.1")
+	cachedInfo(cache, "8.8.8.8")
+	// Rechecks are not counted
+	cache.findAddress(net.ParseIP("8.8.8.8"))
+
+	metrics := cache.render()
+	for _, want := range []string{
+		"traefik_geoblock_cache_hits_total 2\n",
+		"traefik_geoblock_cache_misses_total 1\n",
+		"traefik_geoblock_cache_evictions_total 0\n",
+		"traefik_geoblock_cache_entries 1\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected %q in:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestCacheConcurrentAccess(t *testing.T) {
+	cache := newGeoCache(64)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("10.0.%d.%d", worker, i%200)
+				if cachedInfo(cache, key) == nil {
+					cache.set(key, &geoInfo{Country: "US"}, time.Hour)
+				}
+				cache.setOrganization(key, "Example")
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if size := cache.size(); size > 64 {
+		t.Errorf("Expected at most 64 entries, got %d", size)
+	}
+}
+
+func TestCachePrefixes(t *testing.T) {
+	cache := newGeoCache(100)
+	cache.setPrefixLengths(24, 48)
+
+	mustParse := func(cidr string) *net.IPNet {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Invalid CIDR %s: %v", cidr, err)
+		}
+		return network
+	}
+
+	if key := cache.setAddress(net.ParseIP("1.2.3.4"), &geoInfo{Country: "US"}, time.Hour); key != "1.2.3.0/24" {
+		t.Errorf("Expected the configured prefix as key, got %s", key)
+	}
+	// The provider's network wins over the configured prefix, whether narrower or wider
+	cache.setAddress(net.ParseIP("5.6.7.8"), &geoInfo{Country: "DE", network: mustParse("5.6.7.0/28")}, time.Hour)
+	cache.setAddress(net.ParseIP("9.1.2.3"), &geoInfo{Country: "FR", network: mustParse("9.0.0.0/8")}, time.Hour)
+	cache.setAddress(net.ParseIP("2001:db8:1:2::1"), &geoInfo{Country: "NL"}, time.Hour)
+
+	testCases := []struct {
+		ip       string
+		expected string
+	}{
+		{"1.2.3.200", "US"},
+		{"::ffff:1.2.3.1", "US"},
+		{"1.2.4.1", ""},
+		{"5.6.7.9", "DE"},
+		{"5.6.7.100", ""},
+		{"9.200.1.1", "FR"},
+		{"2001:db8:1:ffff::1", "NL"},
+		{"2001:db8:2::1", ""},
+	}
+
+	for _, tc := range testCases {
+		hit, ok := cache.getAddress(net.ParseIP(tc.ip))
+		if tc.expected == "" {
+			if ok {
+				t.Errorf("getAddress(%s) = %+v, expected a miss", tc.ip, hit.info)
+			}
+			continue
+		}
+		if !ok || hit.info.Country != tc.expected {
+			t.Errorf("getAddress(%s) = %+v, expected %s", tc.ip, hit.info, tc.expected)
+		}
+	}
+
+	// A narrower network is found before the entry of the prefix containing it
+	cache.setAddress(net.ParseIP("1.2.3.4"), &geoInfo{Country: "CA", network: mustParse("1.2.3.0/29")}, time.Hour)
+	if hit, _ := cache.getAddress(net.ParseIP("1.2.3.1")); hit.info.Country != "CA" {
+		t.Errorf("Expected CA from the narrower network, got %+v", hit.info)
+	}
+	if hit, _ := cache.getAddress(net.ParseIP("1.2.3.100")); hit.info.Country != "US" {
+		t.Errorf("Expected US from the prefix, got %+v", hit.info)
+	}
+}
+
+func TestCachePerAddressIgnoresNetworks(t *testing.T) {
+	cache := newGeoCache(100)
+
+	_, network, _ := net.ParseCIDR("5.6.7.0/24")
+	if key := cache.setAddress(net.ParseIP("5.6.7.8"), &geoInfo{Country: "DE", network: network}, time.Hour); key != "5.6.7.8" {
+		t.Errorf("Expected the address as key, got %s", key)
+	}
+	if hit, ok := cache.getAddress(net.ParseIP("5.6.7.9")); ok {
+		t.Errorf("Expected a miss without prefix caching, got %+v", hit.info)
+	}
+}
+
+func TestPrefixCachingSharesLookups(t *testing.T) {
+	apiURL, hits := newProviderAPI(t, http.StatusOK, `{"country_code":"US"}`, 0)
+
+	geoBlock := newProviderTestGeoBlock(t, []ProviderConfig{{Type: ProviderHTTPJSON, URL: apiURL}})
+	geoBlock.cache.setPrefixLengths(24, 48)
+
+	for i := 1; i <= 50; i++ {
+		if info, err := geoBlock.getGeoInfo(fmt.Sprintf("81.2.69.%d", i)); err != nil || info.Country != "US" {
+			t.Fatalf("Unexpected lookup result %+v (%v)", info, err)
+		}
+	}
+	if _, err := geoBlock.getGeoInfo("81.2.70.1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Errorf("Expected one upstream call per /24, got %d", got)
+	}
+}
+
+func TestCacheStaleEntries(t *testing.T) {
+	cache := newGeoCache(100)
+	cache.setStaleDuration(time.Hour)
+	ip := net.ParseIP("1.1.1.1")
+
+	cache.setAddress(ip, &geoInfo{Country: "US"}, -time.Second)
+
+	hit, ok := cache.getAddress(ip)
+	if !ok || !hit.stale || !hit.refresh || hit.info.Country != "US" {
+		t.Fatalf("Expected a stale hit claiming the refresh, got %+v (%v)", hit, ok)
+	}
+	if hit, _ := cache.getAddress(ip); !hit.stale || hit.refresh {
+		t.Error("Expected only one caller to refresh")
+	}
+	if _, ok := cache.findAddress(ip); !ok {
+		t.Error("Expected rechecks to see the stale entry")
+	}
+
+	// A failed refresh is retried after the given delay
+	cache.refreshFailed(hit.key, time.Hour)
+	if hit, _ := cache.getAddress(ip); hit.refresh {
+		t.Error("Expected no refresh before the retry delay")
+	}
+	cache.refreshFailed(hit.key, 0)
+	if hit, _ := cache.getAddress(ip); !hit.refresh {
+		t.Error("Expected a refresh after the retry delay")
+	}
+
+	// Past the stale window the entry is gone
+	cache.setAddress(ip, &geoInfo{Country: "US"}, -2*time.Hour)
+	if _, ok := cache.getAddress(ip); ok {
+		t.Error("Expected entry past its stale window to be removed")
+	}
+
+	metrics := cache.render()
+	if !strings.Contains(metrics, "traefik_geoblock_cache_stale_hits_total 4\n") {
+		t.Errorf("Expected 4 stale hits in:\n%s", metrics)
+	}
+}
+
+func TestCacheNegativeEntries(t *testing.T) {
+	cache := newGeoCache(100)
+	cache.setStaleDuration(time.Hour)
+	ip := net.ParseIP("1.1.1.1")
+	lookupErr := errors.New("upstream unavailable")
+
+	cache.setAddressError(ip, lookupErr, time.Minute)
+	hit, ok := cache.getAddress(ip)
+	if !ok {
+		t.Fatal("Expected the failure to be cached")
+	}
+	if info, err := hit.result(); info != nil || !errors.Is(err, lookupErr) {
+		t.Errorf("Expected the cached error, got %+v (%v)", info, err)
+	}
+
+	// Failures are never served stale
+	cache.setAddressError(ip, lookupErr, -time.Second)
+	if _, ok := cache.getAddress(ip); ok {
+		t.Error("Expected expired failure to be removed")
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	failingURL, failingHits := newProviderAPI(t, http.StatusInternalServerError, "", 0)
+	emptyURL, emptyHits := newProviderAPI(t, http.StatusOK, `{}`, 0)
+
+	for _, tc := range []struct {
+		url      string
+		hits     *int32
+		negative string
+		expected int32
+	}{
+		{failingURL, failingHits, "1m", 1},
+		{emptyURL, emptyHits, "1m", 1},
+		{failingURL, failingHits, "0s", 2},
+	} {
+		atomic.StoreInt32(tc.hits, 0)
+
+		config := CreateConfig()
+		config.Providers = []ProviderConfig{{Type: ProviderHTTPJSON, URL: tc.url, BreakerThreshold: -1}}
+		config.CacheNegativeDuration = tc.negative
+		handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+		if err != nil {
+			t.Fatalf("Failed to create plugin: %v", err)
+		}
+		geoBlock := handler.(*GeoBlock)
+
+		for i := 0; i < 2; i++ {
+			if info, err := geoBlock.getGeoInfo("1.1.1.1"); err == nil && info.Country != CountryUnknown {
+				t.Fatalf("Expected failure or UNKNOWN, got %+v", info)
+			}
+		}
+		if got := atomic.LoadInt32(tc.hits); got != tc.expected {
+			t.Errorf("cacheNegativeDuration %s: expected %d upstream calls, got %d", tc.negative, tc.expected, got)
+		}
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var status int32 = http.StatusOK
+	var country atomic.Value
+	country.Store("US")
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		rw.WriteHeader(int(atomic.LoadInt32(&status)))
+		_, _ = fmt.Fprintf(rw, `{"country_code":%q}`, country.Load())
+	}))
+	defer server.Close()
+
+	config := CreateConfig()
+	config.Providers = []ProviderConfig{{Type: ProviderHTTPJSON, URL: server.URL + "/{ip}", BreakerThreshold: -1}}
+	config.CacheStaleDuration = "1h"
+	config.CacheNegativeDuration = "20ms"
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	geoBlock := handler.(*GeoBlock)
+
+	if info, err := geoBlock.getGeoInfo("1.1.1.1"); err != nil || info.Country != "US" {
+		t.Fatalf("Expected US, got %+v (%v)", info, err)
+	}
+
+	// Expire the answer and take the API down: the stale answer keeps being served
+	geoBlock.cache.set("1.1.1.1", &geoInfo{Country: "US"}, -time.Second)
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	for i := 0; i < 5; i++ {
+		if info, err := geoBlock.getGeoInfo("1.1.1.1"); err != nil || info.Country != "US" {
+			t.Fatalf("Expected the stale US answer during the outage, got %+v (%v)", info, err)
+		}
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&hits) >= 2 })
+
+	// Once the API is back a refresh replaces the stale answer
+	country.Store("DE")
+	atomic.StoreInt32(&status, http.StatusOK)
+	waitFor(t, func() bool {
+		info, err := geoBlock.getGeoInfo("1.1.1.1")
+		return err == nil && info.Country == "DE"
+	})
+}
+
+func TestStaleWhileRevalidateKeepsAnswerWhenUnknown(t *testing.T) {
+	// With negative caching the refresh is retried later, without it on the next request
+	for negative, minHits := range map[string]int32{"1m": 2, "0s": 3} {
+		t.Run(negative, func(t *testing.T) {
+			testStaleAnswerKeptWhenUnknown(t, negative, minHits)
+		})
+	}
+}
+
+func testStaleAnswerKeptWhenUnknown(t *testing.T, negativeDuration string, minHits int32) {
+	var body atomic.Value
+	body.Store(`{"country_code":"US"}`)
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = rw.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+
+	config := CreateConfig()
+	config.Providers = []ProviderConfig{{Type: ProviderHTTPJSON, URL: server.URL + "/{ip}"}}
+	config.CacheStaleDuration = "1h"
+	config.CacheNegativeDuration = negativeDuration
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	geoBlock := handler.(*GeoBlock)
+
+	if info, err := geoBlock.getGeoInfo("1.1.1.1"); err != nil || info.Country != "US" {
+		t.Fatalf("Expected US, got %+v (%v)", info, err)
+	}
+
+	// The API answers without a country: the stale answer stays
+	geoBlock.cache.set("1.1.1.1", &geoInfo{Country: "US"}, -time.Second)
+	body.Store(`{"error":true}`)
+	waitFor(t, func() bool {
+		info, err := geoBlock.getGeoInfo("1.1.1.1")
+		if err != nil || info.Country != "US" {
+			t.Fatalf("Expected the stale US answer, got %+v (%v)", info, err)
+		}
+		return atomic.LoadInt32(&hits) >= minHits
+	})
+	if info, err := geoBlock.getGeoInfo("1.1.1.1"); err != nil || info.Country != "US" {
+		t.Errorf("Expected the stale US answer after the refresh, got %+v (%v)", info, err)
+	}
+}
+
+// waitFor polls condition until it holds or a few seconds have passed
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	cache := newGeoCache(100)
+	cache.setStaleDuration(time.Hour)
+	cache.set("1.1.1.1", &geoInfo{Country: "AU", Organization: "Cloudflare", ASN: 13335, Source: "ipapi"}, time.Hour)
+	cache.set("8.8.8.8", &geoInfo{Country: "US"}, -time.Minute) // stale, still served
+	cache.set("9.9.9.9", &geoInfo{Country: "CH"}, -2*time.Hour) // past its stale window
+	cache.setAddressError(net.ParseIP("5.5.5.5"), errors.New("timeout"), time.Minute)
+
+	saved, err := cache.save(path)
+	if err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+	if saved != 2 {
+		t.Errorf("Expected 2 saved entries, got %d", saved)
+	}
+
+	restored := newGeoCache(100)
+	loaded, err := restored.load(path)
+	if err != nil {
+		t.Fatalf("Failed to load cache: %v", err)
+	}
+	if loaded != 2 {
+		t.Errorf("Expected 2 loaded entries, got %d", loaded)
+	}
+
+	info := cachedInfo(restored, "1.1.1.1")
+	expected := geoInfo{Country: "AU", Organization: "Cloudflare", ASN: 13335, Source: "ipapi"}
+	if info == nil || *info != expected {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+
+	// Expiry times are the original ones: the stale entry is still stale
+	hit, ok := restored.getAddress(net.ParseIP("8.8.8.8"))
+	if !ok || !hit.stale || hit.info.Country != "US" {
+		t.Errorf("Expected a stale US entry, got %+v (%v)", hit, ok)
+	}
+	for _, ip := range []string{"9.9.9.9", "5.5.5.5"} {
+		if _, ok := restored.getAddress(net.ParseIP(ip)); ok {
+			t.Errorf("Expected %s not to be restored", ip)
+		}
+	}
+}
+
+func TestCacheLoadPrefixKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	cache := newGeoCache(100)
+	cache.setPrefixLengths(24, 48)
+	cache.setAddress(net.ParseIP("1.2.3.4"), &geoInfo{Country: "US"}, time.Hour)
+	cache.setAddress(net.ParseIP("2001:db8::1"), &geoInfo{Country: "DE"}, time.Hour)
+	if _, err := cache.save(path); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+
+	restored := newGeoCache(100)
+	restored.setPrefixLengths(24, 48)
+	if loaded, err := restored.load(path); err != nil || loaded != 2 {
+		t.Fatalf("Expected 2 loaded entries, got %d (%v)", loaded, err)
+	}
+	if hit, ok := restored.getAddress(net.ParseIP("1.2.3.99")); !ok || hit.info.Country != "US" {
+		t.Errorf("Expected US for the restored /24, got %+v (%v)", hit.info, ok)
+	}
+	if hit, ok := restored.getAddress(net.ParseIP("2001:db8::ffff")); !ok || hit.info.Country != "DE" {
+		t.Errorf("Expected DE for the restored /48, got %+v (%v)", hit.info, ok)
+	}
+
+	// Network entries are useless without prefix caching
+	if loaded, err := newGeoCache(100).load(path); err != nil || loaded != 0 {
+		t.Errorf("Expected network entries to be skipped, got %d (%v)", loaded, err)
+	}
+}
+
+func TestCacheLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	if loaded, err := newGeoCache(100).load(filepath.Join(dir, "missing.json")); err != nil || loaded != 0 {
+		t.Errorf("Expected a missing snapshot to be ignored, got %d (%v)", loaded, err)
+	}
+
+	for name, content := range map[string]string{
+		"corrupt.json": `{"version":1,"entries":[`,
+		"future.json":  `{"version":99,"entries":[]}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write snapshot: %v", err)
+		}
+		if _, err := newGeoCache(100).load(path); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCachePersistRejectedConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	config := CreateConfig()
+	config.CachePersistPath = path
+	config.Providers = []ProviderConfig{{Type: "unknown"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := New(ctx, http.NotFoundHandler(), config, "test"); err == nil {
+		t.Fatal("Expected error for an invalid provider")
+	}
+	cancel()
+
+	// A persister would write the snapshot as soon as the context ends
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no snapshot from a rejected configuration (%v)", err)
+	}
+}
+
+func TestCachePersistAcrossRestarts(t *testing.T) {
+	apiURL, hits := newProviderAPI(t, http.StatusOK, `{"country_code":"US"}`, 0)
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	newGeoBlock := func(ctx context.Context) *GeoBlock {
+		config := CreateConfig()
+		config.Providers = []ProviderConfig{{Type: ProviderHTTPJSON, URL: apiURL}}
+		config.CachePersistPath = path
+		handler, err := New(ctx, http.NotFoundHandler(), config, "test")
+		if err != nil {
+			t.Fatalf("Failed to create plugin: %v", err)
+		}
+		return handler.(*GeoBlock)
+	}
+
+	// The snapshot is written when the middleware's context ends
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := newGeoBlock(ctx).getGeoInfo("1.1.1.1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cancel()
+	waitFor(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+
+	restarted := newGeoBlock(context.Background())
+	if info, err := restarted.getGeoInfo("1.1.1.1"); err != nil || info.Country != "US" {
+		t.Errorf("Expected the restored US answer, got %+v (%v)", info, err)
+	}
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Errorf("Expected the restored cache to avoid a second lookup, got %d calls", got)
+	}
+}
@@ -0,0 +1,353 @@
+package traefik_geoblock_plugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Client address resolution behind reverse proxies
+
+// spoofLogRate is the number of spoof attempt log lines allowed per minute
+const spoofLogRate = 60
+
+// IP strategies select where the client address is read from. Except for
+// remoteAddr, forwarding headers are only honored when the direct peer
+// (RemoteAddr) is inside trustedProxies; otherwise the peer is the client.
+const (
+	// IPStrategyRemoteAddr uses the address of the direct peer and ignores all headers
+	IPStrategyRemoteAddr = "remoteAddr"
+	// IPStrategyXFFDepth uses the X-Forwarded-For entry at xffDepth, counted from the right
+	IPStrategyXFFDepth = "xffDepth"
+	// IPStrategyRightmostUntrusted uses the rightmost X-Forwarded-For entry outside trustedProxies
+	IPStrategyRightmostUntrusted = "rightmostUntrusted"
+	// IPStrategyForwarded uses the rightmost RFC 7239 Forwarded for= node outside trustedProxies
+	IPStrategyForwarded = "forwarded"
+	// IPStrategyHeader uses a single-IP header such as CF-Connecting-IP or True-Client-IP
+	IPStrategyHeader = "header"
+)
+
+// IPStrategy configures how the client address is extracted from requests
+type IPStrategy struct {
+	Type     string `json:"type,omitempty"`     // remoteAddr, xffDepth, rightmostUntrusted, forwarded or header (default: legacy X-Forwarded-For / X-Real-IP handling)
+	XFFDepth int    `json:"xffDepth,omitempty"` // xffDepth: position of the client in X-Forwarded-For from the right (1 = last entry)
+	Header   string `json:"header,omitempty"`   // header: name of the header holding the client address
+}
+
+// validate checks the options required by the strategy type
+func (s IPStrategy) validate() error {
+	switch s.Type {
+	case "", IPStrategyRemoteAddr, IPStrategyRightmostUntrusted, IPStrategyForwarded:
+		return nil
+	case IPStrategyXFFDepth:
+		if s.XFFDepth < 1 {
+			return errors.New("ipStrategy xffDepth must be at least 1")
+		}
+		return nil
+	case IPStrategyHeader:
+		if strings.TrimSpace(s.Header) == "" {
+			return errors.New("ipStrategy header requires a header name")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported ipStrategy type %q", s.Type)
+	}
+}
+
+// clientIPOptions are the parsed client address options of the configuration
+type clientIPOptions struct {
+	trustedProxies []*net.IPNet
+	strict         bool // forwarding headers only count from trusted proxies
+}
+
+// parseClientIPOptions validates the options deciding which address is the client's
+func parseClientIPOptions(config *Config) (clientIPOptions, error) {
+	var options clientIPOptions
+
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return options, err
+	}
+	if err := config.IPStrategy.validate(); err != nil {
+		return options, err
+	}
+	switch config.ConfigVersion {
+	case 0, ConfigVersionLegacy, ConfigVersionCurrent:
+	default:
+		return options, fmt.Errorf("unsupported configVersion %d", config.ConfigVersion)
+	}
+
+	options.trustedProxies = trustedProxies
+	options.strict = config.ConfigVersion >= ConfigVersionCurrent
+	if config.StrictClientIP != nil {
+		options.strict = *config.StrictClientIP
+	}
+	if len(trustedProxies) == 0 && config.IPStrategy.Type != "" && config.IPStrategy.Type != IPStrategyRemoteAddr {
+		fmt.Printf("[GeoBlock] Warning: ipStrategy %s has no effect without trustedProxies, using the peer address\n", config.IPStrategy.Type)
+	}
+	return options, nil
+}
+
+// parseTrustedProxies parses trustedProxies entries, each an IP address or a
+// CIDR range (IPv4 or IPv6)
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trustedProxies entry %q", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return networks, nil
+}
+
+// parseClientIP parses an address from a request or header, dropping an IPv6
+// zone ("fe80::1%eth0") and unmapping IPv4-mapped IPv6 ("::ffff:203.0.113.5").
+// It returns nil when s is not an address.
+func parseClientIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// normalizeIP returns the canonical form of a client address, so that every
+// spelling of one address shares private range checks, lookups and cache
+// entries. Strings that are not addresses are returned trimmed but unchanged.
+func normalizeIP(s string) string {
+	if ip := parseClientIP(s); ip != nil {
+		return ip.String()
+	}
+	return strings.TrimSpace(s)
+}
+
+// isTrustedProxy reports whether ip lies in one of the trustedProxies ranges
+func (g *GeoBlock) isTrustedProxy(ip net.IP) bool {
+	for _, network := range g.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardingHeaders returns the headers that can carry a client address
+func forwardingHeaders(strategy IPStrategy) []string {
+	headers := []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"}
+	if strategy.Type == IPStrategyHeader {
+		headers = append(headers, strings.TrimSpace(strategy.Header))
+	}
+	return headers
+}
+
+// getClientIP returns the client address according to ipStrategy, normalized by
+// normalizeIP. Whenever the configured source is missing or malformed the direct
+// peer is used.
+func (g *GeoBlock) getClientIP(req *http.Request) string {
+	strategy := g.config.IPStrategy
+	if strategy.Type == "" && !g.strictClientIP {
+		return g.legacyClientIP(req)
+	}
+
+	// Headers sent by anyone but a trusted proxy are forged or meaningless
+	peer := remoteIP(req)
+	if peerIP := parseClientIP(peer); peerIP == nil || !g.isTrustedProxy(peerIP) {
+		// remoteAddr ignores the headers by design, so they are not an attempt
+		if strategy.Type != IPStrategyRemoteAddr {
+			g.reportSpoofAttempt(req, peer)
+		}
+		return peer
+	}
+
+	var client string
+	switch strategy.Type {
+	case "":
+		return g.legacyClientIP(req)
+	case IPStrategyRemoteAddr:
+		return peer
+	case IPStrategyXFFDepth:
+		client = xffDepthIP(forwardedForNodes(req), strategy.XFFDepth)
+	case IPStrategyRightmostUntrusted:
+		client = g.rightmostUntrustedIP(forwardedForNodes(req))
+	case IPStrategyForwarded:
+		client = g.rightmostUntrustedIP(forwardedNodes(req))
+	case IPStrategyHeader:
+		if ip := parseClientIP(req.Header.Get(strategy.Header)); ip != nil {
+			client = ip.String()
+		}
+	}
+
+	if client == "" {
+		return peer
+	}
+	return client
+}
+
+// reportSpoofAttempt counts and logs a forwarding header sent by a peer
+// outside trustedProxies. Headers that only repeat the peer address, as set by
+// Traefik's entrypoint, are not attempts. Log lines are rate limited.
+func (g *GeoBlock) reportSpoofAttempt(req *http.Request, peer string) {
+	for _, header := range g.forwardingHeaders {
+		value := req.Header.Get(header)
+		if value == "" || !claimsOtherAddress(headerAddresses(req, header), peer) {
+			continue
+		}
+
+		g.recordSpoofAttempt(header)
+		if g.spoofLog != nil && g.spoofLog.allow() {
+			fmt.Printf("[GeoBlock] Ignoring %s %q from untrusted peer %s\n", header, value, peer)
+		}
+		return
+	}
+}
+
+// headerAddresses returns the addresses carried by all lines of a forwarding header
+func headerAddresses(req *http.Request, header string) []string {
+	switch http.CanonicalHeaderKey(header) {
+	case "X-Forwarded-For":
+		return forwardedForNodes(req)
+	case "Forwarded":
+		return forwardedNodes(req)
+	default:
+		return req.Header.Values(header)
+	}
+}
+
+// claimsOtherAddress reports whether any of the addresses differs from peer
+func claimsOtherAddress(addresses []string, peer string) bool {
+	for _, address := range addresses {
+		if address = normalizeIP(address); address != "" && address != peer {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyClientIP takes the leftmost X-Forwarded-For entry outside
+// trustedProxies, then X-Real-IP, then RemoteAddr. Both headers can be set by
+// the client, so this is only safe behind a proxy that overwrites them.
+func (g *GeoBlock) legacyClientIP(req *http.Request) string {
+	// Check X-Forwarded-For header
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		ips := strings.Split(xff, ",")
+		// Get the first non-trusted proxy IP
+		for _, ip := range ips {
+			ip = strings.TrimSpace(ip)
+			if parsedIP := parseClientIP(ip); parsedIP != nil && !g.isTrustedProxy(parsedIP) {
+				return parsedIP.String()
+			}
+		}
+	}
+
+	// Check X-Real-IP header
+	if xri := req.Header.Get("X-Real-IP"); xri != "" {
+		return normalizeIP(xri)
+	}
+
+	// Fall back to RemoteAddr
+	return remoteIP(req)
+}
+
+// remoteIP returns the address of the direct peer
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return normalizeIP(req.RemoteAddr)
+	}
+	return normalizeIP(host)
+}
+
+// forwardedForNodes returns the X-Forwarded-For entries of all header lines, in order
+func forwardedForNodes(req *http.Request) []string {
+	var nodes []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, node := range strings.Split(header, ",") {
+			nodes = append(nodes, strings.TrimSpace(node))
+		}
+	}
+	return nodes
+}
+
+// forwardedNodes returns the for= node of each RFC 7239 Forwarded element, in
+// order, with quotes and ports removed. Elements without for= yield "".
+func forwardedNodes(req *http.Request) []string {
+	var nodes []string
+	for _, header := range req.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			node := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(strings.TrimSpace(key), "for") {
+					node = forwardedNodeAddress(value)
+					break
+				}
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// forwardedNodeAddress strips the quotes, brackets and port of a node such as
+// "[2001:db8::1]:4711" or 192.0.2.43:47011. Obfuscated and "unknown" nodes are
+// returned unchanged and fail to parse as addresses.
+func forwardedNodeAddress(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// xffDepthIP returns the node at depth counted from the right (1 = last)
+func xffDepthIP(nodes []string, depth int) string {
+	if depth > len(nodes) {
+		return ""
+	}
+	if ip := parseClientIP(nodes[len(nodes)-depth]); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// rightmostUntrustedIP walks the nodes from the right, skipping trustedProxies,
+// and returns the first other address. Nodes left of a malformed one cannot be
+// trusted, so "" is returned; when every node is trusted the leftmost is used.
+func (g *GeoBlock) rightmostUntrustedIP(nodes []string) string {
+	client := ""
+	for i := len(nodes) - 1; i >= 0; i-- {
+		ip := parseClientIP(nodes[i])
+		if ip == nil {
+			return ""
+		}
+		client = ip.String()
+		if !g.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,423 @@
+package traefik_geoblock_plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8", " 192.168.1.10 ", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{"10.0.0.0/8", "192.168.1.10/32", "2001:db8::/32", "::1/128"}
+	if len(networks) != len(expected) {
+		t.Fatalf("Expected %d networks, got %d", len(expected), len(networks))
+	}
+	for i, network := range networks {
+		if network.String() != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], network)
+		}
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "proxy.internal", "", "10.0.0.1-10.0.0.9"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("Expected error for %q", entry)
+		}
+	}
+}
+
+func TestNewRejectsInvalidTrustedProxies(t *testing.T) {
+	config := CreateConfig()
+	config.TrustedProxies = []string{"10.0.0.0/8", "10.0.0.300"}
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Error("Expected error for invalid trustedProxies entry")
+	}
+}
+
+func TestTrustedProxyRanges(t *testing.T) {
+	config := CreateConfig()
+	config.TrustedProxies = []string{"10.0.0.0/8", "172.16.0.0/12", "2001:db8::/32", "203.0.113.7"}
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	geoBlock := handler.(*GeoBlock)
+
+	for ip, trusted := range map[string]bool{
+		"10.1.2.3":        true,
+		"::ffff:10.1.2.3": true,
+		"172.31.255.255":  true,
+		"172.32.0.1":      false,
+		"2001:db8:1::1":   true,
+		"2001:db9::1":     false,
+		"203.0.113.7":     true,
+		"203.0.113.8":     false,
+		"11.0.0.1":        false,
+		"::ffff:11.0.0.1": false,
+	} {
+		if got := geoBlock.isTrustedProxy(net.ParseIP(ip)); got != trusted {
+			t.Errorf("isTrustedProxy(%s) = %v, expected %v", ip, got, trusted)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		xff      string
+		expected string
+	}{
+		{"proxies inside declared ranges are skipped", "10.20.30.40, 5.6.7.8", "5.6.7.8"},
+		{"IPv6 proxy range", "2001:db8::5, 172.16.4.4, 9.9.9.9", "9.9.9.9"},
+		{"single trusted address", "203.0.113.7, 8.8.4.4", "8.8.4.4"},
+		{"first untrusted address wins", "5.6.7.8, 10.0.0.1", "5.6.7.8"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			req.RemoteAddr = "10.0.0.2:1234"
+			req.Header.Set("X-Forwarded-For", tc.xff)
+
+			if got := geoBlock.getClientIP(req); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestIPStrategies(t *testing.T) {
+	const (
+		proxy     = "10.0.0.2:1234" // inside trustedProxies
+		untrusted = "198.51.100.9:1234"
+	)
+
+	testCases := []struct {
+		name       string
+		strategy   IPStrategy
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{"remoteAddr ignores headers", IPStrategy{Type: IPStrategyRemoteAddr}, proxy,
+			map[string][]string{"X-Forwarded-For": {"5.6.7.8"}, "X-Real-Ip": {"5.6.7.8"}}, "10.0.0.2"},
+
+		{"xffDepth 1", IPStrategy{Type: IPStrategyXFFDepth, XFFDepth: 1}, proxy,
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1, 5.6.7.8"}}, "5.6.7.8"},
+		{"xffDepth 2 across header lines", IPStrategy{Type: IPStrategyXFFDepth, XFFDepth: 2}, proxy,
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1, 2.2.2.2", "10.0.0.9"}}, "2.2.2.2"},
+		{"xffDepth deeper than the header", IPStrategy{Type: IPStrategyXFFDepth, XFFDepth: 3}, proxy,
+			map[string][]string{"X-Forwarded-For": {"5.6.7.8"}}, "10.0.0.2"},
+		{"xffDepth from an untrusted peer", IPStrategy{Type: IPStrategyXFFDepth, XFFDepth: 1}, untrusted,
+			map[string][]string{"X-Forwarded-For": {"5.6.7.8"}}, "198.51.100.9"},
+
+		{"rightmostUntrusted skips proxies", IPStrategy{Type: IPStrategyRightmostUntrusted}, proxy,
+			map[string][]string{"X-Forwarded-For": {"6.6.6.6, 5.6.7.8, 10.1.1.1, 2001:db8::7"}}, "5.6.7.8"},
+		{"rightmostUntrusted ignores forged entries", IPStrategy{Type: IPStrategyRightmostUntrusted}, proxy,
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1, 5.6.7.8"}}, "5.6.7.8"},
+		{"rightmostUntrusted stops at malformed entries", IPStrategy{Type: IPStrategyRightmostUntrusted}, proxy,
+			map[string][]string{"X-Forwarded-For": {"5.6.7.8, garbage, 10.1.1.1"}}, "10.0.0.2"},
+		{"rightmostUntrusted with only proxies", IPStrategy{Type: IPStrategyRightmostUntrusted}, proxy,
+			map[string][]string{"X-Forwarded-For": {"10.3.3.3, 10.1.1.1"}}, "10.3.3.3"},
+		{"rightmostUntrusted from an untrusted peer", IPStrategy{Type: IPStrategyRightmostUntrusted}, untrusted,
+			map[string][]string{"X-Forwarded-For": {"5.6.7.8"}}, "198.51.100.9"},
+
+		{"forwarded", IPStrategy{Type: IPStrategyForwarded}, proxy,
+			map[string][]string{"Forwarded": {`for=192.0.2.60;proto=http;by=203.0.113.43`}}, "192.0.2.60"},
+		{"forwarded IPv6 with port", IPStrategy{Type: IPStrategyForwarded}, proxy,
+			map[string][]string{"Forwarded": {`For="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"forwarded rightmost untrusted", IPStrategy{Type: IPStrategyForwarded}, proxy,
+			map[string][]string{"Forwarded": {`for=1.1.1.1, for="192.0.2.43:47011"`, `for=10.1.1.1;proto=https`}}, "192.0.2.43"},
+		{"forwarded obfuscated node", IPStrategy{Type: IPStrategyForwarded}, proxy,
+			map[string][]string{"Forwarded": {`for=_hidden, for=10.1.1.1`}}, "10.0.0.2"},
+		{"forwarded unknown node", IPStrategy{Type: IPStrategyForwarded}, proxy,
+			map[string][]string{"Forwarded": {`for=unknown`}}, "10.0.0.2"},
+		{"forwarded ignores X-Forwarded-For", IPStrategy{Type: IPStrategyForwarded}, proxy,
+			map[string][]string{"X-Forwarded-For": {"5.6.7.8"}}, "10.0.0.2"},
+
+		{"header", IPStrategy{Type: IPStrategyHeader, Header: "CF-Connecting-IP"}, proxy,
+			map[string][]string{"Cf-Connecting-Ip": {"5.6.7.8"}, "X-Forwarded-For": {"1.1.1.1"}}, "5.6.7.8"},
+		{"header with IPv6", IPStrategy{Type: IPStrategyHeader, Header: "True-Client-IP"}, proxy,
+			map[string][]string{"True-Client-Ip": {" 2001:db8::1 "}}, "2001:db8::1"},
+		{"header malformed", IPStrategy{Type: IPStrategyHeader, Header: "True-Client-IP"}, proxy,
+			map[string][]string{"True-Client-Ip": {"5.6.7.8, 1.1.1.1"}}, "10.0.0.2"},
+		{"header from an untrusted peer", IPStrategy{Type: IPStrategyHeader, Header: "CF-Connecting-IP"}, untrusted,
+			map[string][]string{"Cf-Connecting-Ip": {"5.6.7.8"}}, "198.51.100.9"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::/32"}
+			config.IPStrategy = tc.strategy
+
+			handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+			if err != nil {
+				t.Fatalf("Failed to create plugin: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for name, values := range tc.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+
+			if got := handler.(*GeoBlock).getClientIP(req); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidConfigVersion(t *testing.T) {
+	config := CreateConfig()
+	config.ConfigVersion = 3
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Error("Expected error for unsupported configVersion")
+	}
+}
+
+func TestNewRejectsInvalidIPStrategy(t *testing.T) {
+	for _, strategy := range []IPStrategy{
+		{Type: "leftmost"},
+		{Type: IPStrategyXFFDepth},
+		{Type: IPStrategyHeader},
+	} {
+		config := CreateConfig()
+		config.IPStrategy = strategy
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+			t.Errorf("Expected error for %+v", strategy)
+		}
+	}
+}
+
+func TestStrictClientIP(t *testing.T) {
+	enabled, disabled := true, false
+
+	testCases := []struct {
+		name          string
+		configVersion int
+		strict        *bool
+		remoteAddr    string
+		expected      string
+	}{
+		{"legacy config honors headers from anyone", 0, nil, "198.51.100.9:1234", "8.8.8.8"},
+		{"version 2 ignores headers from untrusted peers", ConfigVersionCurrent, nil, "198.51.100.9:1234", "198.51.100.9"},
+		{"version 2 honors headers from trusted proxies", ConfigVersionCurrent, nil, "10.0.0.2:1234", "8.8.8.8"},
+		{"strictClientIP overrides version 2", ConfigVersionCurrent, &disabled, "198.51.100.9:1234", "8.8.8.8"},
+		{"strictClientIP on a legacy config", ConfigVersionLegacy, &enabled, "198.51.100.9:1234", "198.51.100.9"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ConfigVersion = tc.configVersion
+			config.StrictClientIP = tc.strict
+			config.TrustedProxies = []string{"10.0.0.0/8"}
+
+			handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+			if err != nil {
+				t.Fatalf("Failed to create plugin: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("X-Real-IP", "8.8.8.8")
+
+			if got := handler.(*GeoBlock).getClientIP(req); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSpoofAttemptMetrics(t *testing.T) {
+	config := CreateConfig()
+	config.ConfigVersion = ConfigVersionCurrent
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	config.IPStrategy = IPStrategy{Type: IPStrategyHeader, Header: "CF-Connecting-IP"}
+	config.PrometheusMetricsPath = "/__geoblock_metrics"
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	geoBlock := handler.(*GeoBlock)
+
+	requests := []struct {
+		remoteAddr string
+		header     string
+		value      string
+	}{
+		{"198.51.100.9:1234", "X-Real-IP", "8.8.8.8"},
+		{"198.51.100.9:1234", "X-Real-IP", "8.8.8.8"},
+		{"198.51.100.10:1234", "CF-Connecting-IP", "8.8.8.8"},
+		{"198.51.100.10:1234", "X-Forwarded-For", "8.8.8.8, 198.51.100.10"},
+		{"198.51.100.11:1234", "", ""},            // no forwarding header: not an attempt
+		{"10.0.0.2:1234", "X-Real-IP", "8.8.8.8"}, // trusted proxy: not an attempt
+		{"8.8.8.8:1234", "X-Real-IP", "8.8.8.8"},  // set by Traefik's entrypoint: not an attempt
+		{"8.8.8.8:1234", "X-Forwarded-For", "8.8.8.8"},
+		{"[2001:4860::1]:1234", "Forwarded", `for="[2001:4860:0::1]:4711"`},
+	}
+	for _, r := range requests {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		req.RemoteAddr = r.remoteAddr
+		if r.header != "" {
+			req.Header.Set(r.header, r.value)
+		}
+		geoBlock.getClientIP(req)
+	}
+
+	rec := httptest.NewRecorder()
+	geoBlock.servePrometheusMetrics(rec)
+	metrics := rec.Body.String()
+	for _, want := range []string{
+		`traefik_geoblock_spoof_attempts_total{header="X-Real-IP"} 2`,
+		`traefik_geoblock_spoof_attempts_total{header="CF-Connecting-IP"} 1`,
+		`traefik_geoblock_spoof_attempts_total{header="X-Forwarded-For"} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected %q in:\n%s", want, metrics)
+		}
+	}
+	if strings.Contains(metrics, `header="Forwarded"`) {
+		t.Errorf("Expected a Forwarded header repeating the peer not to count:\n%s", metrics)
+	}
+}
+
+func TestSpoofAttemptsIgnoredHeaders(t *testing.T) {
+	strictOff := false
+	for name, configure := range map[string]func(config *Config){
+		"remoteAddr strategy": func(config *Config) {
+			config.ConfigVersion = ConfigVersionCurrent
+			config.IPStrategy = IPStrategy{Type: IPStrategyRemoteAddr}
+		},
+		"legacy without strictClientIP": func(config *Config) {
+			config.ConfigVersion = ConfigVersionCurrent
+			config.StrictClientIP = &strictOff
+		},
+	} {
+		config := CreateConfig()
+		config.TrustedProxies = []string{"10.0.0.0/8"}
+		config.PrometheusMetricsPath = "/__geoblock_metrics"
+		configure(config)
+
+		handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+		if err != nil {
+			t.Fatalf("%s: failed to create plugin: %v", name, err)
+		}
+		geoBlock := handler.(*GeoBlock)
+
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		req.RemoteAddr = "198.51.100.9:1234"
+		req.Header.Set("X-Real-IP", "8.8.8.8")
+		geoBlock.getClientIP(req)
+
+		if metrics := geoBlock.promMetrics.render(); strings.Contains(metrics, "spoof_attempts_total{") {
+			t.Errorf("%s: expected no spoof attempts, got:\n%s", name, metrics)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	testCases := map[string]string{
+		"203.0.113.5":            "203.0.113.5",
+		" 203.0.113.5 ":          "203.0.113.5",
+		"::ffff:203.0.113.5":     "203.0.113.5",
+		"::FFFF:cb00:7105":       "203.0.113.5",
+		"2001:DB8:0::1":          "2001:db8::1",
+		"fe80::1%eth0":           "fe80::1",
+		"::ffff:203.0.113.5%lo0": "203.0.113.5",
+		"not-an-ip":              "not-an-ip",
+		"":                       "",
+	}
+
+	for input, expected := range testCases {
+		if got := normalizeIP(input); got != expected {
+			t.Errorf("normalizeIP(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+func TestClientIPNormalization(t *testing.T) {
+	testCases := []struct {
+		name       string
+		strategy   IPStrategy
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"mapped peer", IPStrategy{}, "[::ffff:203.0.113.5]:1234", nil, "203.0.113.5"},
+		{"zoned peer", IPStrategy{}, "[fe80::1%eth0]:1234", nil, "fe80::1"},
+		{"legacy X-Forwarded-For", IPStrategy{}, "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "::ffff:203.0.113.5"}, "203.0.113.5"},
+		{"legacy X-Real-IP", IPStrategy{}, "10.0.0.2:1234", map[string]string{"X-Real-IP": "::ffff:203.0.113.5"}, "203.0.113.5"},
+		{"mapped trusted peer", IPStrategy{Type: IPStrategyRemoteAddr}, "[::ffff:10.0.0.2]:1234", nil, "10.0.0.2"},
+		{"header", IPStrategy{Type: IPStrategyHeader, Header: "CF-Connecting-IP"}, "[::ffff:10.0.0.2]:1234", map[string]string{"CF-Connecting-IP": "::ffff:203.0.113.5"}, "203.0.113.5"},
+		{"xffDepth", IPStrategy{Type: IPStrategyXFFDepth, XFFDepth: 1}, "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "fe80::1%eth0"}, "fe80::1"},
+		{"mapped proxy skipped", IPStrategy{Type: IPStrategyRightmostUntrusted}, "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "203.0.113.5, ::ffff:10.0.0.3"}, "203.0.113.5"},
+		{"forwarded", IPStrategy{Type: IPStrategyForwarded}, "10.0.0.2:1234", map[string]string{"Forwarded": `for="[::ffff:203.0.113.5]:4711"`}, "203.0.113.5"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.IPStrategy = tc.strategy
+			config.TrustedProxies = []string{"10.0.0.0/8"}
+
+			handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+			if err != nil {
+				t.Fatalf("Failed to create plugin: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+
+			if got := handler.(*GeoBlock).getClientIP(req); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestGeoInfoNormalization(t *testing.T) {
+	geoBlock := newProviderTestGeoBlock(t, []ProviderConfig{
+		{Type: ProviderStaticMap, Entries: map[string]string{"81.2.69.0/24": "IT"}},
+	})
+
+	testCases := []struct {
+		ip       string
+		expected string
+	}{
+		{"::ffff:10.1.2.3", CategoryPrivate},
+		{"::ffff:127.0.0.1", CategoryPrivate},
+		{"fe80::1%eth0", CategoryPrivate},
+		{"81.2.69.5", "IT"},
+		{"::ffff:81.2.69.5", "IT"},
+		{"::ffff:5102:4505%eth0", "IT"},
+	}
+
+	for _, tc := range testCases {
+		info, err := geoBlock.getGeoInfo(tc.ip)
+		if err != nil || info.Country != tc.expected {
+			t.Errorf("%s: expected %s, got %+v (%v)", tc.ip, tc.expected, info, err)
+		}
+	}
+
+	// Every spelling of 81.2.69.5 shares one cache entry
+	if size := geoBlock.cache.size(); size != 1 {
+		t.Errorf("Expected 1 cache entry, got %d", size)
+	}
+}
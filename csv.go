@@ -0,0 +1,220 @@
+package traefik_geoblock_plugin
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+)
+
+// CSV range database parsers
+
+func newCSVReader(r io.Reader) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	return reader
+}
+
+// parseDBIPCSV parses DB-IP lite CSV files. Both the country layout
+// (start,end,country) and the city layout (start,end,continent,country,...) are
+// supported; the files have no header row.
+func parseDBIPCSV(r io.Reader, builder *rangeIndexBuilder) (int, error) {
+	reader := newCSVReader(r)
+	added := 0
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return added, nil
+		}
+		if err != nil {
+			return added, fmt.Errorf("failed to read dbip csv: %w", err)
+		}
+		if len(record) < 3 {
+			continue
+		}
+
+		rec := geoRecord{country: strings.ToUpper(record[2])}
+		if len(record) >= 8 {
+			rec = geoRecord{country: strings.ToUpper(record[3]), continent: strings.ToUpper(record[2])}
+		}
+
+		startIP := net.ParseIP(strings.TrimSpace(record[0]))
+		endIP := net.ParseIP(strings.TrimSpace(record[1]))
+		if startIP != nil && endIP != nil && isCountryCode(rec.country) && builder.add(startIP, endIP, rec) {
+			added++
+		}
+	}
+}
+
+// parseIP2LocationCSV parses IP2Location LITE CSV files, where ranges are
+// expressed as decimal integers (128-bit for the IPv6 editions, with IPv4
+// ranges mapped into ::ffff:0:0/96).
+func parseIP2LocationCSV(r io.Reader, builder *rangeIndexBuilder) (int, error) {
+	reader := newCSVReader(r)
+	added := 0
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return added, nil
+		}
+		if err != nil {
+			return added, fmt.Errorf("failed to read ip2location csv: %w", err)
+		}
+		if len(record) < 3 {
+			continue
+		}
+
+		startIP, endIP := decimalRange(record[0], record[1])
+		if startIP != nil && isCountryCode(record[2]) &&
+			builder.add(startIP, endIP, geoRecord{country: strings.ToUpper(record[2])}) {
+			added++
+		}
+	}
+}
+
+// newGeoLite2Parser returns a parser for GeoLite2/GeoIP2 Country or City block
+// files, joining geoname ids against the given locations. Repeated header rows
+// are skipped so the IPv4 and IPv6 block files can simply be concatenated.
+func newGeoLite2Parser(locations map[string]geoRecord) rangeParser {
+	return func(r io.Reader, builder *rangeIndexBuilder) (int, error) {
+		reader := newCSVReader(r)
+		added := 0
+		networkCol, geonameCol, registeredCol := -1, -1, -1
+
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return added, nil
+			}
+			if err != nil {
+				return added, fmt.Errorf("failed to read geolite2 csv: %w", err)
+			}
+
+			if csvColumn(record, "network") >= 0 {
+				networkCol = csvColumn(record, "network")
+				geonameCol = csvColumn(record, "geoname_id")
+				registeredCol = csvColumn(record, "registered_country_geoname_id")
+				continue
+			}
+			if networkCol < 0 || geonameCol < 0 {
+				return added, errors.New("geolite2 csv is missing its header row")
+			}
+			if networkCol >= len(record) || geonameCol >= len(record) {
+				continue
+			}
+
+			location, ok := locations[record[geonameCol]]
+			if (!ok || location.country == "") && registeredCol >= 0 && registeredCol < len(record) {
+				location, ok = locations[record[registeredCol]]
+			}
+			if !ok || location.country == "" {
+				continue
+			}
+
+			_, network, err := net.ParseCIDR(record[networkCol])
+			if err != nil {
+				continue
+			}
+			startIP, endIP := networkRange(network)
+			if builder.add(startIP, endIP, location) {
+				added++
+			}
+		}
+	}
+}
+
+// loadGeoLite2Locations reads a GeoLite2 locations file (e.g. GeoLite2-Country-Locations-en.csv)
+func loadGeoLite2Locations(path string) (map[string]geoRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open locations file: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read locations header: %w", err)
+	}
+	idCol := csvColumn(header, "geoname_id")
+	countryCol := csvColumn(header, "country_iso_code")
+	continentCol := csvColumn(header, "continent_code")
+	if idCol < 0 || countryCol < 0 {
+		return nil, errors.New("locations file must have geoname_id and country_iso_code columns")
+	}
+
+	locations := make(map[string]geoRecord)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return locations, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read locations file: %w", err)
+		}
+		if idCol >= len(record) || countryCol >= len(record) {
+			continue
+		}
+
+		location := geoRecord{country: strings.ToUpper(record[countryCol])}
+		if continentCol >= 0 && continentCol < len(record) {
+			location.continent = strings.ToUpper(record[continentCol])
+		}
+		locations[record[idCol]] = location
+	}
+}
+
+// csvColumn returns the index of the named column in a header row, or -1
+func csvColumn(header []string, name string) int {
+	for i, column := range header {
+		if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// networkRange returns the first and last address of network
+func networkRange(network *net.IPNet) (net.IP, net.IP) {
+	start := network.IP.Mask(network.Mask)
+	end := make(net.IP, len(start))
+	for i := range start {
+		end[i] = start[i] | ^network.Mask[i]
+	}
+	return start, end
+}
+
+// decimalRange converts an IP2Location decimal range to IPs. Ranges ending
+// within 32 bits are IPv4; anything larger is IPv6. It returns nil IPs for
+// malformed input.
+func decimalRange(startValue, endValue string) (net.IP, net.IP) {
+	start, ok := new(big.Int).SetString(strings.TrimSpace(startValue), 10)
+	if !ok || start.Sign() < 0 {
+		return nil, nil
+	}
+	end, ok := new(big.Int).SetString(strings.TrimSpace(endValue), 10)
+	if !ok || end.BitLen() > 128 || start.Cmp(end) > 0 {
+		return nil, nil
+	}
+
+	size := net.IPv6len
+	if end.BitLen() <= 32 {
+		size = net.IPv4len
+	}
+	return net.IP(start.FillBytes(make([]byte, size))), net.IP(end.FillBytes(make([]byte, size)))
+}
+
+// isCountryCode reports whether s looks like an ISO 3166-1 alpha-2 code
+// (IP2Location uses "-" and DB-IP "ZZ" for unassigned space)
+func isCountryCode(s string) bool {
+	return len(s) == 2 && s != "-" && !strings.EqualFold(s, "ZZ")
+}
@@ -0,0 +1,113 @@
+package traefik_geoblock_plugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func assertIndexLookups(t *testing.T, index *rangeIndex, expected map[string]string) {
+	t.Helper()
+
+	for ip, country := range expected {
+		record, _ := index.lookup(net.ParseIP(ip))
+		if record.country != country {
+			t.Errorf("lookup(%s) = %q, expected %q", ip, record.country, country)
+		}
+	}
+}
+
+func TestParseDBIPCSV(t *testing.T) {
+	index := buildTestIndex(t, parseDBIPCSV, `1.0.0.0,1.0.0.255,AU
+1.0.1.0,1.0.3.255,CN
+2.0.0.0,2.0.0.255,ZZ
+2001:200::,2001:200:ffff:ffff:ffff:ffff:ffff:ffff,JP
+3.0.0.0,3.0.0.255,NA,US,Virginia,Ashburn,39.0,-77.4
+`)
+
+	assertIndexLookups(t, index, map[string]string{
+		"1.0.0.1":     "AU",
+		"1.0.2.1":     "CN",
+		"2.0.0.1":     "",
+		"2001:200::1": "JP",
+		"3.0.0.1":     "US",
+	})
+}
+
+func TestParseIP2LocationCSV(t *testing.T) {
+	index := buildTestIndex(t, parseIP2LocationCSV, `"0","16777215","-","-"
+"16777216","16777471","US","United States of America"
+"16777472","16778239","CN","China"
+"281470698586112","281470698586367","AU","Australia"
+"42540528726795050063891204319802818560","42540528806023212578155541913346768895","JP","Japan"
+`)
+
+	assertIndexLookups(t, index, map[string]string{
+		"0.0.0.1":        "",
+		"1.0.0.1":        "US",
+		"1.0.1.1":        "CN",
+		"1.0.0.0":        "US",
+		"::ffff:1.0.0.1": "US",
+		"2001:200::1":    "JP",
+	})
+
+	// The IPv6 edition maps IPv4 space into ::ffff:0:0/96
+	if record, _ := index.lookup(net.ParseIP("1.1.0.1")); record.country != "AU" {
+		t.Errorf("Expected mapped IPv4 range to resolve to AU, got %q", record.country)
+	}
+}
+
+func TestParseGeoLite2CSV(t *testing.T) {
+	dir := t.TempDir()
+	locationsPath := filepath.Join(dir, "GeoLite2-Country-Locations-en.csv")
+	locations := `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,is_in_european_union
+2077456,en,OC,Oceania,AU,Australia,0
+2921044,en,EU,Europe,DE,Germany,1
+6255148,en,EU,Europe,,,0
+`
+	if err := os.WriteFile(locationsPath, []byte(locations), 0o600); err != nil {
+		t.Fatalf("Failed to write locations: %v", err)
+	}
+
+	db := &localDatabase{locationsPath: locationsPath}
+	parse, err := db.parser(DatabaseFormatGeoLite2CSV)
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	// IPv4 and IPv6 block files concatenated, including the repeated header
+	index := buildTestIndex(t, parse, `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider
+1.0.0.0/24,2077456,2077456,,0,0
+2.56.8.0/22,6255148,2921044,,0,0
+network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider
+2a02:2e0::/29,2921044,2921044,,0,0
+`)
+
+	assertIndexLookups(t, index, map[string]string{
+		"1.0.0.77":    "AU",
+		"2.56.9.1":    "DE", // falls back to the registered country
+		"2a02:2e0::1": "DE",
+		"1.0.1.1":     "",
+	})
+
+	if _, err := (&localDatabase{}).parser(DatabaseFormatGeoLite2CSV); err == nil {
+		t.Error("Expected error when databaseLocationsPath is missing")
+	}
+}
+
+func TestLoadDatabaseFromFileDetectsCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dbip-country-lite.csv")
+	if err := os.WriteFile(path, []byte("8.8.8.0,8.8.8.255,US\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+
+	g := &GeoBlock{localDB: &localDatabase{filePath: path}}
+	if err := g.loadDatabaseFromFile(); err != nil {
+		t.Fatalf("Failed to load database: %v", err)
+	}
+
+	if info := g.lookupLocalDatabase("8.8.8.8"); info == nil || info.Country != "US" {
+		t.Errorf("Expected US, got %+v", info)
+	}
+}
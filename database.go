@@ -0,0 +1,333 @@
+package traefik_geoblock_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Local database generations, validation and atomic replacement
+
+const (
+	// previousSuffix is appended to the database path to keep the last good generation
+	previousSuffix = ".prev"
+	// metadataSuffix is appended to the database path for the download validators
+	metadataSuffix = ".meta"
+)
+
+// databaseMetadata holds the HTTP validators of the installed download, so
+// refreshes can be sent as conditional requests
+type databaseMetadata struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// databaseSnapshot is one fully parsed generation of the local database. New
+// generations are built and validated as snapshots before being activated, so a
+// bad download never replaces the data currently in use.
+type databaseSnapshot struct {
+	index   *rangeIndex
+	mmdb    *mmdbReader
+	asnMMDB *mmdbReader
+	modTime time.Time
+	path    string // file the generation was read from
+}
+
+// readSnapshot parses the database file at path without activating it
+func (db *localDatabase) readSnapshot(path string) (*databaseSnapshot, error) {
+	format := db.format
+	if format == "" {
+		detected, err := detectDatabaseFormat(path)
+		if err != nil {
+			return nil, err
+		}
+		format = detected
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat database file: %w", err)
+	}
+	snapshot := &databaseSnapshot{modTime: stat.ModTime(), path: path}
+
+	if format == DatabaseFormatMMDB {
+		if snapshot.mmdb, err = openMMDB(path); err != nil {
+			return nil, err
+		}
+		if db.asnFilePath != "" {
+			if snapshot.asnMMDB, err = openMMDB(db.asnFilePath); err != nil {
+				return nil, fmt.Errorf("failed to load ASN database: %w", err)
+			}
+		}
+		return snapshot, nil
+	}
+
+	parse, err := db.parser(format)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database file: %w", err)
+	}
+	defer file.Close()
+
+	builder := &rangeIndexBuilder{}
+	if _, err := parse(bufio.NewReader(file), builder); err != nil {
+		return nil, err
+	}
+	snapshot.index = builder.build()
+
+	return snapshot, nil
+}
+
+// validate rejects snapshots that are suspiciously small or do not cover the configured sample IPs
+func (db *localDatabase) validate(snapshot *databaseSnapshot) error {
+	if size := snapshot.size(); size < db.minRows {
+		return fmt.Errorf("database has %d entries, expected at least %d", size, db.minRows)
+	}
+
+	for _, ip := range db.validationIPs {
+		if snapshot.lookup(ip) == nil {
+			return fmt.Errorf("database does not cover sample IP %s", ip)
+		}
+	}
+
+	return nil
+}
+
+// activate makes snapshot the database used for lookups
+func (db *localDatabase) activate(snapshot *databaseSnapshot) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.active = snapshot
+	db.lastUpdate = snapshot.modTime
+}
+
+// touch records that the active generation was confirmed up to date at t. The
+// file time is updated too, so the freshness check survives restarts.
+func (db *localDatabase) touch(t time.Time) {
+	db.mu.Lock()
+	db.lastUpdate = t
+	db.mu.Unlock()
+
+	_ = os.Chtimes(db.filePath, t, t)
+}
+
+// emptySnapshot stands in for the database until a generation is activated
+var emptySnapshot = &databaseSnapshot{}
+
+// current returns the active generation. Snapshots are never modified once
+// activated, so the pointer can be used without holding the lock.
+func (db *localDatabase) current() *databaseSnapshot {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.active == nil {
+		return emptySnapshot
+	}
+	return db.active
+}
+
+// lastUpdated returns when the active generation was installed or last confirmed up to date
+func (db *localDatabase) lastUpdated() time.Time {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.lastUpdate
+}
+
+// lookup returns the answer for ip, or nil when the address is not covered or has no country
+func (s *databaseSnapshot) lookup(ip net.IP) *geoInfo {
+	if s.mmdb != nil {
+		return lookupMMDB(s.mmdb, s.asnMMDB, ip)
+	}
+
+	record, network, ok := s.index.lookupNetwork(ip)
+	if !ok || record.country == "" || record.country == CountryUnknown {
+		return nil
+	}
+
+	return &geoInfo{
+		Country:      record.country,
+		Organization: record.asName,
+		Continent:    record.continent,
+		ASN:          record.asn,
+		ASDomain:     record.asDomain,
+		network:      network,
+	}
+}
+
+// size returns the number of ranges (search tree nodes for mmdb databases)
+func (s *databaseSnapshot) size() int {
+	if s.mmdb != nil {
+		return int(s.mmdb.nodeCount)
+	}
+	return s.index.size()
+}
+
+// stageDatabaseFile writes src to a temporary file next to path and fsyncs it
+func stageDatabaseFile(path string, src io.Reader) (string, error) {
+	staged, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging file: %w", err)
+	}
+
+	_, err = io.Copy(staged, src)
+	if err == nil {
+		err = staged.Sync()
+	}
+	if closeErr := staged.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(staged.Name())
+		return "", fmt.Errorf("failed to save database: %w", err)
+	}
+
+	return staged.Name(), nil
+}
+
+// installDatabaseFile atomically moves staged into place at path. With
+// keepCurrent the current file is kept as the previous generation; otherwise it
+// is replaced, so an unusable file never overwrites the last good generation.
+func installDatabaseFile(staged, path string, keepCurrent bool) error {
+	if _, err := os.Stat(path); err == nil && keepCurrent {
+		if err := os.Rename(path, path+previousSuffix); err != nil {
+			return fmt.Errorf("failed to keep previous database: %w", err)
+		}
+	}
+
+	if err := os.Rename(staged, path); err != nil {
+		return fmt.Errorf("failed to install database: %w", err)
+	}
+
+	// Persist the renames; not every platform supports syncing a directory
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// databaseFileWatch tracks the database file between polls. A change is only
+// reported once the file has stopped changing for one poll, so a file that is
+// still being copied into place is not loaded half-written.
+type databaseFileWatch struct {
+	seen    os.FileInfo // last file reported
+	pending os.FileInfo // changed file waiting to settle
+}
+
+// changed records stat and reports whether it is a settled change
+func (w *databaseFileWatch) changed(stat os.FileInfo) bool {
+	if sameFileVersion(stat, w.seen) {
+		w.pending = nil
+		return false
+	}
+	if !sameFileVersion(stat, w.pending) {
+		w.pending = stat
+		return false
+	}
+
+	w.seen, w.pending = stat, nil
+	return true
+}
+
+func sameFileVersion(a, b os.FileInfo) bool {
+	return a != nil && b != nil && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// readDatabaseMetadata returns the saved validators, or an empty value when none are usable
+func readDatabaseMetadata(path string) databaseMetadata {
+	var metadata databaseMetadata
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &metadata) != nil {
+		return databaseMetadata{}
+	}
+	return metadata
+}
+
+// writeDatabaseMetadata atomically replaces the validators saved at path
+func writeDatabaseMetadata(path string, metadata databaseMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode database metadata: %w", err)
+	}
+
+	staged, err := stageDatabaseFile(path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(staged, path); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("failed to save database metadata: %w", err)
+	}
+	return nil
+}
+
+// nextRefreshDelay returns how long to wait before the next refresh of a
+// database last updated at lastUpdate. The interval is jittered by up to ±10%
+// and the delay never drops below a tenth of it, which also paces retries.
+func nextRefreshDelay(lastUpdate time.Time, interval time.Duration) time.Duration {
+	delay := interval
+	if spread := int64(interval / 10); spread > 0 {
+		delay += time.Duration(rand.Int63n(2*spread+1) - spread)
+	}
+	delay -= time.Since(lastUpdate)
+
+	if floor := interval / 10; delay < floor {
+		delay = floor
+	}
+	return delay
+}
+
+// fetchChecksum downloads a SHA-256 sidecar file ("<hex>" or "<hex>  <filename>")
+func fetchChecksum(client *http.Client, auth requestAuth, url string) (string, error) {
+	req, err := auth.newRequest(context.Background(), url)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download checksum: %w", auth.redactError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("checksum download returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("failed to read checksum: %w", err)
+	}
+
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", errors.New("checksum file is empty")
+	}
+	checksum := strings.ToLower(fields[0])
+	if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 checksum %q", fields[0])
+	}
+
+	return checksum, nil
+}
@@ -0,0 +1,413 @@
+package traefik_geoblock_plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newDatabaseServer serves the database at / and its SHA-256 sidecar at /sha256
+func newDatabaseServer(t *testing.T, body *string, checksum *string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/sha256" {
+			_, _ = rw.Write([]byte(*checksum + "  db.csv\n"))
+			return
+		}
+		_, _ = rw.Write([]byte(*body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDownloadDatabaseKeepsPreviousGeneration(t *testing.T) {
+	body := "1.0.0.0,1.0.0.255,AU\n"
+	server := newDatabaseServer(t, &body, nil)
+
+	path := filepath.Join(t.TempDir(), "db.csv")
+	g := &GeoBlock{localDB: &localDatabase{downloadURL: server.URL, filePath: path, minRows: 1}}
+
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("First download failed: %v", err)
+	}
+
+	body = "1.0.0.0,1.0.0.255,AU\n8.8.8.0,8.8.8.255,US\n"
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("Second download failed: %v", err)
+	}
+
+	if info := g.lookupLocalDatabase("8.8.8.8"); info == nil || info.Country != "US" {
+		t.Errorf("Expected new generation to be active, got %+v", info)
+	}
+
+	previous, err := os.ReadFile(path + previousSuffix)
+	if err != nil || string(previous) != "1.0.0.0,1.0.0.255,AU\n" {
+		t.Errorf("Expected previous generation on disk, got %q (%v)", previous, err)
+	}
+
+	// No staging or download leftovers next to the database
+	matches, _ := filepath.Glob(path + ".*-*")
+	if len(matches) != 0 {
+		t.Errorf("Expected temporary files to be cleaned up, found %v", matches)
+	}
+}
+
+func TestDownloadDatabaseRejectsInvalidGeneration(t *testing.T) {
+	good := "1.0.0.0,1.0.0.255,AU\n8.8.8.0,8.8.8.255,US\n"
+	testCases := []struct {
+		name     string
+		body     string
+		checksum string
+		minRows  int
+		sample   string
+	}{
+		{name: "too few rows", body: "1.0.0.0,1.0.0.255,AU\n", minRows: 2},
+		{name: "sample IP not covered", body: "1.0.0.0,1.0.0.255,AU\n9.9.9.0,9.9.9.255,CH\n", sample: "8.8.8.8"},
+		{name: "checksum mismatch", body: good, checksum: sha256Hex("something else")},
+		{name: "unparseable", body: "<html>rate limited</html>"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := good
+			checksum := ""
+			server := newDatabaseServer(t, &body, &checksum)
+
+			path := filepath.Join(t.TempDir(), "db.csv")
+			db := &localDatabase{downloadURL: server.URL, filePath: path, minRows: 1}
+			g := &GeoBlock{localDB: db}
+			if err := g.downloadDatabase(); err != nil {
+				t.Fatalf("Initial download failed: %v", err)
+			}
+
+			body = tc.body
+			if tc.checksum != "" {
+				checksum = tc.checksum
+				db.checksumURL = server.URL + "/sha256"
+			}
+			if tc.minRows > 0 {
+				db.minRows = tc.minRows
+			}
+			if tc.sample != "" {
+				db.validationIPs = []net.IP{net.ParseIP(tc.sample)}
+			}
+
+			if err := g.downloadDatabase(); err == nil {
+				t.Fatal("Expected download to be rejected")
+			}
+
+			if info := g.lookupLocalDatabase("8.8.8.8"); info == nil || info.Country != "US" {
+				t.Errorf("Expected last good database to stay active, got %+v", info)
+			}
+			onDisk, err := os.ReadFile(path)
+			if err != nil || string(onDisk) != good {
+				t.Errorf("Expected database file to be unchanged, got %q (%v)", onDisk, err)
+			}
+		})
+	}
+}
+
+func TestDownloadDatabaseVerifiesChecksum(t *testing.T) {
+	body := "8.8.8.0,8.8.8.255,US\n"
+	checksum := sha256Hex(body)
+	server := newDatabaseServer(t, &body, &checksum)
+
+	g := &GeoBlock{localDB: &localDatabase{
+		downloadURL: server.URL,
+		checksumURL: server.URL + "/sha256",
+		filePath:    filepath.Join(t.TempDir(), "db.csv"),
+	}}
+
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("Download with matching checksum failed: %v", err)
+	}
+	if info := g.lookupLocalDatabase("8.8.8.8"); info == nil || info.Country != "US" {
+		t.Errorf("Expected US, got %+v", info)
+	}
+}
+
+func TestLoadDatabaseFromFileRollsBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.csv")
+	// A crash mid-write leaves a truncated file behind
+	if err := os.WriteFile(path, []byte("8.8.8.0,8.8."), 0o600); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	if err := os.WriteFile(path+previousSuffix, []byte("8.8.8.0,8.8.8.255,US\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write previous database: %v", err)
+	}
+
+	g := &GeoBlock{localDB: &localDatabase{filePath: path, format: DatabaseFormatDBIPCSV, minRows: 1}}
+	if err := g.loadDatabaseFromFile(); err != nil {
+		t.Fatalf("Expected rollback to previous generation, got error: %v", err)
+	}
+
+	if info := g.lookupLocalDatabase("8.8.8.8"); info == nil || info.Country != "US" {
+		t.Errorf("Expected US from previous generation, got %+v", info)
+	}
+}
+
+func TestDownloadDatabaseConditional(t *testing.T) {
+	body := "8.8.8.0,8.8.8.255,US\n"
+	var fullDownloads, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullDownloads++
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		_, _ = rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "db.csv")
+	newGeoBlock := func() *GeoBlock {
+		return &GeoBlock{localDB: &localDatabase{downloadURL: server.URL, filePath: path, minRows: 1, refreshInterval: time.Hour}}
+	}
+
+	g := newGeoBlock()
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("First download failed: %v", err)
+	}
+	if metadata := readDatabaseMetadata(path + metadataSuffix); metadata.ETag != `"v1"` || metadata.URL != server.URL {
+		t.Fatalf("Expected validators to be saved, got %+v", metadata)
+	}
+
+	// Simulate a restart with a stale database: the validators are reused from disk
+	stale := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, stale, stale); err != nil {
+		t.Fatalf("Failed to age database: %v", err)
+	}
+	g = newGeoBlock()
+	if err := g.loadLocalDatabase(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	if fullDownloads != 1 || notModified != 1 {
+		t.Errorf("Expected 1 full download and 1 revalidation, got %d and %d", fullDownloads, notModified)
+	}
+	if info := g.lookupLocalDatabase("8.8.8.8"); info == nil || info.Country != "US" {
+		t.Errorf("Expected database to stay active after 304, got %+v", info)
+	}
+	if stat, err := os.Stat(path); err != nil || !stat.ModTime().After(stale) {
+		t.Errorf("Expected database file time to be refreshed after 304 (%v)", err)
+	}
+
+	// A fresh database is not revalidated at all
+	if err := newGeoBlock().loadLocalDatabase(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if fullDownloads+notModified != 2 {
+		t.Errorf("Expected no request for a fresh database, got %d in total", fullDownloads+notModified)
+	}
+}
+
+func TestRollbackDiscardsValidators(t *testing.T) {
+	body := "8.8.8.0,8.8.8.255,US\n"
+	var fullDownloads, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullDownloads++
+		rw.Header().Set("ETag", `"v1"`)
+		_, _ = rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "db.csv")
+	newGeoBlock := func() *GeoBlock {
+		return &GeoBlock{localDB: &localDatabase{downloadURL: server.URL, filePath: path, format: DatabaseFormatDBIPCSV, minRows: 1, refreshInterval: time.Hour}}
+	}
+
+	if err := newGeoBlock().downloadDatabase(); err != nil {
+		t.Fatalf("First download failed: %v", err)
+	}
+
+	// The installed file gets corrupted; an older generation is still around
+	if err := os.WriteFile(path, []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("Failed to corrupt database: %v", err)
+	}
+	if err := os.WriteFile(path+previousSuffix, []byte("1.0.0.0,1.0.0.255,AU\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write previous database: %v", err)
+	}
+
+	g := newGeoBlock()
+	if err := g.loadDatabaseFromFile(); err != nil {
+		t.Fatalf("Expected rollback to previous generation, got error: %v", err)
+	}
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("Refresh after rollback failed: %v", err)
+	}
+
+	if fullDownloads != 2 || notModified != 0 {
+		t.Errorf("Expected the refresh after a rollback to download again, got %d downloads and %d revalidations", fullDownloads, notModified)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != body {
+		t.Errorf("Expected the database to be replaced, got %q (%v)", data, err)
+	}
+	if info := g.lookupLocalDatabase("8.8.8.8"); info == nil || info.Country != "US" {
+		t.Errorf("Expected US from the downloaded database, got %+v", info)
+	}
+}
+
+func TestInstallAfterRollbackKeepsPreviousGeneration(t *testing.T) {
+	body := "1.0.0.0,1.0.0.255,AU\n"
+	server := newDatabaseServer(t, &body, nil)
+
+	path := filepath.Join(t.TempDir(), "db.csv")
+	newGeoBlock := func() *GeoBlock {
+		return &GeoBlock{localDB: &localDatabase{downloadURL: server.URL, filePath: path, format: DatabaseFormatDBIPCSV, minRows: 1}}
+	}
+
+	g := newGeoBlock()
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("First download failed: %v", err)
+	}
+	good := "1.0.0.0,1.0.0.255,AU\n8.8.8.0,8.8.8.255,US\n"
+	body = good
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("Second download failed: %v", err)
+	}
+
+	// The installed file gets corrupted and the restart rolls back to .prev
+	if err := os.WriteFile(path, []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("Failed to corrupt database: %v", err)
+	}
+	g = newGeoBlock()
+	if err := g.loadDatabaseFromFile(); err != nil {
+		t.Fatalf("Expected rollback to previous generation, got error: %v", err)
+	}
+
+	body = "1.0.0.0,1.0.0.255,AU\n9.9.9.0,9.9.9.255,CH\n"
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("Download after rollback failed: %v", err)
+	}
+
+	// The corrupt file is replaced; the last good generation stays as .prev
+	if previous, err := os.ReadFile(path + previousSuffix); err != nil || string(previous) != "1.0.0.0,1.0.0.255,AU\n" {
+		t.Errorf("Expected the last good generation as .prev, got %q (%v)", previous, err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != body {
+		t.Errorf("Expected the new database to be installed, got %q (%v)", data, err)
+	}
+
+	// The next install rotates the now active file as usual
+	body = good
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("Download after install failed: %v", err)
+	}
+	if previous, err := os.ReadFile(path + previousSuffix); err != nil || string(previous) != "1.0.0.0,1.0.0.255,AU\n9.9.9.0,9.9.9.255,CH\n" {
+		t.Errorf("Expected the replaced generation as .prev, got %q (%v)", previous, err)
+	}
+}
+
+func TestNextRefreshDelay(t *testing.T) {
+	interval := 10 * time.Hour
+
+	for i := 0; i < 100; i++ {
+		delay := nextRefreshDelay(time.Now(), interval)
+		if delay < 9*time.Hour-time.Second || delay > 11*time.Hour {
+			t.Fatalf("Expected delay within ±10%% of %v, got %v", interval, delay)
+		}
+	}
+
+	if delay := nextRefreshDelay(time.Now().Add(-8*time.Hour), interval); delay > 3*time.Hour+time.Second {
+		t.Errorf("Expected the age of the database to be subtracted, got %v", delay)
+	}
+
+	// Overdue or never loaded databases are retried after a tenth of the interval
+	if delay := nextRefreshDelay(time.Time{}, interval); delay != time.Hour {
+		t.Errorf("Expected %v, got %v", time.Hour, delay)
+	}
+}
+
+func TestDatabaseFileWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.csv")
+	writeVersion := func(data string, modTime time.Time) os.FileInfo {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatalf("Failed to write database: %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set database time: %v", err)
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat database: %v", err)
+		}
+		return stat
+	}
+
+	base := time.Now().Add(-time.Hour)
+	watch := &databaseFileWatch{seen: writeVersion("1.0.0.0,1.0.0.255,AU\n", base)}
+
+	if watch.changed(watch.seen) {
+		t.Error("Expected unchanged file not to be reported")
+	}
+
+	// A file still being written is reported only once it stops changing
+	partial := writeVersion("8.8.8.0,8.8", base.Add(time.Minute))
+	if watch.changed(partial) {
+		t.Error("Expected first sighting of a change to wait for the file to settle")
+	}
+	complete := writeVersion("8.8.8.0,8.8.8.255,US\n", base.Add(2*time.Minute))
+	if watch.changed(complete) {
+		t.Error("Expected a still changing file to wait for the file to settle")
+	}
+	if !watch.changed(complete) {
+		t.Error("Expected settled change to be reported")
+	}
+	if watch.changed(complete) {
+		t.Error("Expected change to be reported once")
+	}
+}
+
+func TestReloadDatabaseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.csv")
+	if err := os.WriteFile(path, []byte("1.0.0.0,1.0.0.255,AU\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+
+	g := &GeoBlock{localDB: &localDatabase{filePath: path, minRows: 1}}
+	if err := g.loadDatabaseFromFile(); err != nil {
+		t.Fatalf("Failed to load database: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("8.8.8.0,8.8.8.255,US\n"), 0o600); err != nil {
+		t.Fatalf("Failed to replace database: %v", err)
+	}
+	if err := g.reloadDatabaseFile(); err != nil {
+		t.Fatalf("Failed to reload database: %v", err)
+	}
+	if info := g.lookupLocalDatabase("8.8.8.8"); info == nil || info.Country != "US" {
+		t.Errorf("Expected replaced database to be active, got %+v", info)
+	}
+
+	// A broken replacement keeps the active database
+	if err := os.WriteFile(path, []byte("not a database"), 0o600); err != nil {
+		t.Fatalf("Failed to replace database: %v", err)
+	}
+	if err := g.reloadDatabaseFile(); err == nil {
+		t.Error("Expected error for a broken replacement")
+	}
+	if info := g.lookupLocalDatabase("8.8.8.8"); info == nil || info.Country != "US" {
+		t.Errorf("Expected previous database to stay active, got %+v", info)
+	}
+}
@@ -0,0 +1,273 @@
+package traefik_geoblock_plugin
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Database format detection and parser registry
+
+// rangeParser reads a range database from r into builder and returns the number of rows added
+type rangeParser func(r io.Reader, builder *rangeIndexBuilder) (int, error)
+
+// mmdbMetadataMaxSize is the maximum distance of the metadata marker from the end of an mmdb file
+const mmdbMetadataMaxSize = 128 * 1024
+
+func isValidDatabaseFormat(format string) bool {
+	switch format {
+	case "", DatabaseFormatJSON, DatabaseFormatMMDB, DatabaseFormatDBIPCSV,
+		DatabaseFormatIP2LocationCSV, DatabaseFormatGeoLite2CSV:
+		return true
+	}
+	return false
+}
+
+// detectDatabaseFormat guesses the format of the database file at path from its
+// content: the mmdb metadata marker, a JSON opening token or the CSV header row.
+func detectDatabaseFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open database file: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat database file: %w", err)
+	}
+
+	tailSize := stat.Size()
+	if tailSize > mmdbMetadataMaxSize {
+		tailSize = mmdbMetadataMaxSize
+	}
+	tail := make([]byte, tailSize)
+	if _, err := file.ReadAt(tail, stat.Size()-tailSize); err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read database file: %w", err)
+	}
+	if bytes.Contains(tail, mmdbMetadataMarker) {
+		return DatabaseFormatMMDB, nil
+	}
+
+	head := make([]byte, 4096)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read database file: %w", err)
+	}
+
+	return detectTextFormat(head[:n])
+}
+
+func detectTextFormat(head []byte) (string, error) {
+	trimmed := bytes.TrimLeft(head, " \t\r\n\ufeff")
+	if len(trimmed) == 0 {
+		return "", errors.New("database file is empty")
+	}
+	if trimmed[0] == '[' || trimmed[0] == '{' {
+		return DatabaseFormatJSON, nil
+	}
+
+	line := trimmed
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields, err := csv.NewReader(bytes.NewReader(line)).Read()
+	if err != nil || len(fields) < 3 {
+		return "", errors.New("unable to detect database format")
+	}
+
+	first := strings.ToLower(strings.TrimSpace(fields[0]))
+	switch {
+	case first == "network" && csvColumn(fields, "geoname_id") >= 0:
+		return DatabaseFormatGeoLite2CSV, nil
+	case isDecimal(first):
+		return DatabaseFormatIP2LocationCSV, nil
+	case net.ParseIP(first) != nil:
+		return DatabaseFormatDBIPCSV, nil
+	}
+
+	return "", fmt.Errorf("unable to detect database format from header %q", string(line))
+}
+
+// parser returns the rangeParser for format
+func (db *localDatabase) parser(format string) (rangeParser, error) {
+	switch format {
+	case DatabaseFormatJSON:
+		return parseIPInfoJSON, nil
+	case DatabaseFormatDBIPCSV:
+		return parseDBIPCSV, nil
+	case DatabaseFormatIP2LocationCSV:
+		return parseIP2LocationCSV, nil
+	case DatabaseFormatGeoLite2CSV:
+		if db.locationsPath == "" {
+			return nil, errors.New("geolite2-csv format requires databaseLocationsPath")
+		}
+		locations, err := loadGeoLite2Locations(db.locationsPath)
+		if err != nil {
+			return nil, err
+		}
+		return newGeoLite2Parser(locations), nil
+	}
+	return nil, fmt.Errorf("format %q is not a range database", format)
+}
+
+// parseIPInfoJSON streams an ipinfo lite database, accepting either a JSON
+// array or NDJSON (one object per line, as ipinfo ships it). Entries are added
+// to the builder one at a time so the decoded rows are never held in memory.
+// Both the legacy start_ip/end_ip/country schema and the current network-based
+// schema with continent and ASN columns are understood.
+func parseIPInfoJSON(r io.Reader, builder *rangeIndexBuilder) (int, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode database: %w", err)
+	}
+
+	decoder := json.NewDecoder(br)
+	isArray := first == '['
+	if isArray {
+		if _, err := decoder.Token(); err != nil {
+			return 0, fmt.Errorf("failed to decode database: %w", err)
+		}
+	}
+
+	added := 0
+	for {
+		if isArray && !decoder.More() {
+			break
+		}
+
+		var entry ipInfoLiteEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if !isArray && err == io.EOF {
+				break
+			}
+			return added, fmt.Errorf("failed to decode database entry %d: %w", added+1, err)
+		}
+
+		if entry.add(builder) {
+			added++
+		}
+	}
+
+	if isArray {
+		if _, err := decoder.Token(); err != nil {
+			return added, fmt.Errorf("failed to decode database: %w", err)
+		}
+	}
+
+	return added, nil
+}
+
+// add converts the entry to a range and adds it to builder
+func (e *ipInfoLiteEntry) add(builder *rangeIndexBuilder) bool {
+	var startIP, endIP net.IP
+	if e.Network != "" {
+		_, network, err := net.ParseCIDR(e.Network)
+		if err != nil {
+			return false
+		}
+		startIP, endIP = networkRange(network)
+	} else {
+		startIP, endIP = net.ParseIP(e.StartIP), net.ParseIP(e.EndIP)
+		if startIP == nil || endIP == nil {
+			return false
+		}
+	}
+
+	// In the current schema "country" is the full name and the code has its own column
+	country := e.CountryCode
+	if country == "" && len(e.Country) == 2 {
+		country = e.Country
+	}
+	continent := e.ContinentCode
+	if continent == "" && len(e.Continent) == 2 {
+		continent = e.Continent
+	}
+
+	return builder.add(startIP, endIP, geoRecord{
+		country:   strings.ToUpper(country),
+		continent: strings.ToUpper(continent),
+		asn:       parseASN(e.ASN),
+		asName:    e.ASName,
+		asDomain:  e.ASDomain,
+	})
+}
+
+// peekNonSpace skips leading whitespace (and a UTF-8 BOM) and returns the next byte without consuming it
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = br.ReadByte()
+			continue
+		}
+		if bom, _ := br.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+			_, _ = br.Discard(3)
+			continue
+		}
+		return b[0], nil
+	}
+}
+
+// unpackDownload returns a reader over the database contained in a download,
+// transparently handling gzip compression and tar archives (as shipped by
+// MaxMind). The returned close function must always be called.
+func unpackDownload(r io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReader(r)
+	closeFn := func() {}
+
+	src := br
+	if head, _ := br.Peek(2); len(head) == 2 && head[0] == 0x1f && head[1] == 0x8b {
+		gzReader, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, closeFn, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		closeFn = func() { gzReader.Close() }
+		src = bufio.NewReader(gzReader)
+	}
+
+	if head, _ := src.Peek(262); len(head) == 262 && string(head[257:262]) == "ustar" {
+		tarReader := tar.NewReader(src)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return nil, closeFn, errors.New("no database file found in archive")
+			}
+			if err != nil {
+				return nil, closeFn, fmt.Errorf("failed to read archive: %w", err)
+			}
+			if header.Typeflag == tar.TypeReg && isDatabaseFileName(header.Name) {
+				return tarReader, closeFn, nil
+			}
+		}
+	}
+
+	return src, closeFn, nil
+}
+
+func isDatabaseFileName(name string) bool {
+	for _, ext := range []string{".mmdb", ".csv", ".json"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDecimal(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
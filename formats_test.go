@@ -0,0 +1,251 @@
+package traefik_geoblock_plugin
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDetectTextFormat(t *testing.T) {
+	testCases := []struct {
+		name     string
+		head     string
+		expected string
+	}{
+		{"JSON array", "\n[{\"start_ip\":\"1.0.0.0\"}]", DatabaseFormatJSON},
+		{"NDJSON", "{\"network\":\"1.0.0.0/24\"}\n", DatabaseFormatJSON},
+		{"DB-IP", "1.0.0.0,1.0.0.255,AU\n", DatabaseFormatDBIPCSV},
+		{"DB-IP IPv6", "2001:200::,2001:200::ffff,JP\n", DatabaseFormatDBIPCSV},
+		{"IP2Location", "\"16777216\",\"16777471\",\"US\",\"United States\"\n", DatabaseFormatIP2LocationCSV},
+		{"GeoLite2", "\ufeffnetwork,geoname_id,registered_country_geoname_id\n", DatabaseFormatGeoLite2CSV},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			format, err := detectTextFormat([]byte(tc.head))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if format != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, format)
+			}
+		})
+	}
+
+	if _, err := detectTextFormat([]byte("hello world\n")); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestUnpackDownload(t *testing.T) {
+	payload := []byte("1.0.0.0,1.0.0.255,AU\n")
+
+	var gzipped bytes.Buffer
+	gzWriter := gzip.NewWriter(&gzipped)
+	tarWriter := tar.NewWriter(gzWriter)
+	_ = tarWriter.WriteHeader(&tar.Header{Name: "dir/README.txt", Mode: 0o644, Size: 2, Typeflag: tar.TypeReg})
+	_, _ = tarWriter.Write([]byte("hi"))
+	_ = tarWriter.WriteHeader(&tar.Header{Name: "dir/db.csv", Mode: 0o644, Size: int64(len(payload)), Typeflag: tar.TypeReg})
+	_, _ = tarWriter.Write(payload)
+	_ = tarWriter.Close()
+	_ = gzWriter.Close()
+
+	for name, input := range map[string][]byte{"plain": payload, "tar.gz": gzipped.Bytes()} {
+		src, closeSrc, err := unpackDownload(bytes.NewReader(input))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		got, err := io.ReadAll(src)
+		closeSrc()
+		if err != nil {
+			t.Fatalf("%s: failed to read: %v", name, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("%s: expected %q, got %q", name, payload, got)
+		}
+	}
+}
+
+func TestDownloadDatabaseCSV(t *testing.T) {
+	var gzipped bytes.Buffer
+	gzWriter := gzip.NewWriter(&gzipped)
+	_, _ = gzWriter.Write([]byte("9.9.9.0,9.9.9.255,CH\n"))
+	_ = gzWriter.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(gzipped.Bytes())
+	}))
+	defer server.Close()
+
+	g := &GeoBlock{localDB: &localDatabase{
+		downloadURL: server.URL,
+		filePath:    filepath.Join(t.TempDir(), "db", "dbip.csv"),
+	}}
+
+	if err := g.downloadDatabase(); err != nil {
+		t.Fatalf("Failed to download database: %v", err)
+	}
+
+	if info := g.lookupLocalDatabase("9.9.9.9"); info == nil || info.Country != "CH" {
+		t.Errorf("Expected CH, got %+v", info)
+	}
+}
+
+func TestParseIPInfoJSONStreaming(t *testing.T) {
+	expected := map[string]string{"1.0.0.1": "AU", "2001:200::1": "JP", "8.8.8.8": ""}
+
+	testCases := map[string]string{
+		"array": `[
+			{"start_ip": "1.0.0.0", "end_ip": "1.0.0.255", "country": "AU"},
+			{"start_ip": "2001:200::", "end_ip": "2001:200::ffff", "country": "jp"}
+		]`,
+		"ndjson": "{\"start_ip\": \"1.0.0.0\", \"end_ip\": \"1.0.0.255\", \"country\": \"AU\"}\n" +
+			"{\"start_ip\": \"2001:200::\", \"end_ip\": \"2001:200::ffff\", \"country\": \"JP\"}\n",
+		"empty array": "[]",
+	}
+
+	for name, data := range testCases {
+		t.Run(name, func(t *testing.T) {
+			builder := &rangeIndexBuilder{}
+			added, err := parseIPInfoJSON(strings.NewReader(data), builder)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if name == "empty array" {
+				if added != 0 {
+					t.Errorf("Expected no entries, got %d", added)
+				}
+				return
+			}
+			if added != 2 {
+				t.Errorf("Expected 2 entries, got %d", added)
+			}
+			assertIndexLookups(t, builder.build(), expected)
+		})
+	}
+
+	if _, err := parseIPInfoJSON(strings.NewReader(`[{"start_ip": "1.0.0.0"`), &rangeIndexBuilder{}); err == nil {
+		t.Error("Expected error for truncated array")
+	}
+}
+
+// writeSyntheticNDJSON writes n contiguous IPv4 ipinfo lite entries to a temp file
+func writeSyntheticNDJSON(b *testing.B, n int) string {
+	b.Helper()
+
+	path := filepath.Join(b.TempDir(), "ipinfo_lite.json")
+	file, err := os.Create(path)
+	if err != nil {
+		b.Fatalf("Failed to create database: %v", err)
+	}
+	defer file.Close()
+
+	countries := []string{"US", "DE", "IT", "FR", "CN", "BR", "JP", "GB"}
+	w := bufio.NewWriter(file)
+	step := uint32((1 << 32) / uint64(n))
+	for i := 0; i < n; i++ {
+		start, end := uint32(i)*step, uint32(i)*step+step-1
+		fmt.Fprintf(w, `{"start_ip":"%d.%d.%d.%d","end_ip":"%d.%d.%d.%d","country":"%s"}`+"\n",
+			start>>24, byte(start>>16), byte(start>>8), byte(start),
+			end>>24, byte(end>>16), byte(end>>8), byte(end), countries[i%len(countries)])
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatalf("Failed to write database: %v", err)
+	}
+	return path
+}
+
+// BenchmarkParseIPInfoJSONMemory reports the peak heap observed while streaming
+// a large NDJSON database next to the heap retained by the final index.
+func BenchmarkParseIPInfoJSONMemory(b *testing.B) {
+	path := writeSyntheticNDJSON(b, 500000)
+
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		var peak uint64
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(5 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				var m runtime.MemStats
+				runtime.ReadMemStats(&m)
+				if m.HeapAlloc > atomic.LoadUint64(&peak) {
+					atomic.StoreUint64(&peak, m.HeapAlloc)
+				}
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+
+		g := &GeoBlock{localDB: &localDatabase{filePath: path, format: DatabaseFormatJSON}}
+		if err := g.loadDatabaseFromFile(); err != nil {
+			b.Fatalf("Failed to load database: %v", err)
+		}
+		close(done)
+		wg.Wait()
+
+		runtime.GC()
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+
+		b.ReportMetric(float64(atomic.LoadUint64(&peak)-before.HeapAlloc)/(1<<20), "peak-heap-MB")
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/(1<<20), "index-heap-MB")
+		runtime.KeepAlive(g)
+	}
+}
+
+func TestParseIPInfoJSONCurrentSchema(t *testing.T) {
+	data := `{"network":"1.1.1.0/24","country":"Australia","country_code":"AU","continent":"Oceania","continent_code":"OC","asn":"AS13335","as_name":"Cloudflare, Inc.","as_domain":"cloudflare.com"}
+{"network":"2606:4700::/32","country":"United States","country_code":"US","continent":"North America","continent_code":"NA","asn":"AS13335","as_name":"Cloudflare, Inc.","as_domain":"cloudflare.com"}
+{"network":"not-a-network","country_code":"IT"}
+`
+	builder := &rangeIndexBuilder{}
+	added, err := parseIPInfoJSON(strings.NewReader(data), builder)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if added != 2 {
+		t.Errorf("Expected 2 entries, got %d", added)
+	}
+
+	g := &GeoBlock{localDB: &localDatabase{active: &databaseSnapshot{index: builder.build()}}}
+
+	info := g.lookupLocalDatabase("1.1.1.1")
+	if info != nil {
+		if info.network == nil || info.network.String() != "1.1.1.0/24" {
+			t.Errorf("Expected matched network 1.1.1.0/24, got %v", info.network)
+		}
+		info.network = nil
+	}
+	expected := geoInfo{Country: "AU", Continent: "OC", ASN: 13335, Organization: "Cloudflare, Inc.", ASDomain: "cloudflare.com"}
+	if info == nil || *info != expected {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+
+	if info := g.lookupLocalDatabase("2606:4700::1111"); info == nil || info.Country != "US" || info.Continent != "NA" {
+		t.Errorf("Expected US/NA, got %+v", info)
+	}
+}
@@ -2,10 +2,11 @@
 package traefik_geoblock_plugin
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -27,50 +28,125 @@ const (
 	ActionAllow = "allow"
 	// ActionBlock represents the block action
 	ActionBlock = "block"
+	// OrganizationSourceNone disables organization lookups
+	OrganizationSourceNone = "none"
+	// OrganizationSourceLocalDB takes the organization from the local database only
+	OrganizationSourceLocalDB = "localdb"
+	// OrganizationSourceAPIAsync fills missing organizations from queryURL in the background
+	OrganizationSourceAPIAsync = "api-async"
+	// DatabaseFormatJSON is the ipinfo lite JSON database format
+	DatabaseFormatJSON = "json"
+	// DatabaseFormatMMDB is the MaxMind DB binary format
+	DatabaseFormatMMDB = "mmdb"
+	// DatabaseFormatDBIPCSV is the DB-IP lite CSV format (start IP, end IP, country)
+	DatabaseFormatDBIPCSV = "dbip-csv"
+	// DatabaseFormatIP2LocationCSV is the IP2Location LITE CSV format (integer ranges)
+	DatabaseFormatIP2LocationCSV = "ip2location-csv"
+	// DatabaseFormatGeoLite2CSV is the GeoLite2 blocks CSV format joined with its locations file
+	DatabaseFormatGeoLite2CSV = "geolite2-csv"
+	// ConfigVersionLegacy keeps the historical defaults
+	ConfigVersionLegacy = 1
+	// ConfigVersionCurrent turns on the secure defaults (strictClientIP) and the
+	// separate LOOPBACK, LINKLOCAL and CGNAT categories
+	ConfigVersionCurrent = 2
 )
 
 // Config holds the plugin configuration
 type Config struct {
-	AllowedCountries      []string `json:"allowedCountries,omitempty"`
-	BlockedCountries      []string `json:"blockedCountries,omitempty"`
-	QueryURL              string   `json:"queryURL,omitempty"`      // API endpoint for querying (e.g., https://ipapi.co/{ip}/json/)
-	DatabaseURL           string   `json:"databaseURL,omitempty"`   // URL to download local database (e.g., https://ipinfo.io/data/ipinfo_lite.json.gz?token=TOKEN)
-	DatabasePath          string   `json:"databasePath,omitempty"`  // Path to store local database
-	CacheDuration         int      `json:"cacheDuration,omitempty"` // in minutes
-	DefaultAction         string   `json:"defaultAction,omitempty"` // "allow" or "block"
-	BlockMessage          string   `json:"blockMessage,omitempty"`
-	BlockPageTitle        string   `json:"blockPageTitle,omitempty"`
-	BlockPageBody         string   `json:"blockPageBody,omitempty"`
-	RedirectURL           string   `json:"redirectURL,omitempty"` // URL to redirect blocked users (optional)
-	LogBlocked            bool     `json:"logBlocked,omitempty"`  // Legacy logging (stdout with IPs)
-	TrustedProxies        []string `json:"trustedProxies,omitempty"`
-	MetricsLogPath        string   `json:"metricsLogPath,omitempty"`        // Path for Grafana-compatible metrics logs (deprecated, use PrometheusMetricsPath)
-	MetricsFlushSeconds   int      `json:"metricsFlushSeconds,omitempty"`   // How often to flush metrics (default: 60)
-	LogRetentionDays      int      `json:"logRetentionDays,omitempty"`      // Days to retain logs (default: 14)
-	EnableMetricsLog      bool     `json:"enableMetricsLog,omitempty"`      // Enable Grafana-compatible logging (deprecated, use PrometheusMetricsPath)
-	PrometheusMetricsPath string   `json:"prometheusMetricsPath,omitempty"` // Path to expose Prometheus metrics endpoint (e.g., "/__geoblock_metrics")
+	ConfigVersion           int               `json:"configVersion,omitempty"` // 2 turns on the secure defaults such as strictClientIP (default: 1)
+	AllowedCountries        []string          `json:"allowedCountries,omitempty"`
+	BlockedCountries        []string          `json:"blockedCountries,omitempty"`
+	QueryURL                string            `json:"queryURL,omitempty"`                // API endpoint for querying (e.g., https://ipapi.co/{ip}/json/)
+	CountryField            string            `json:"countryField,omitempty"`            // Dotted path to the country code in queryURL responses (e.g. "location.country.code")
+	OrganizationField       string            `json:"organizationField,omitempty"`       // Dotted path to the organization in queryURL responses
+	ASNField                string            `json:"asnField,omitempty"`                // Dotted path to the AS number in queryURL responses
+	ContinentField          string            `json:"continentField,omitempty"`          // Dotted path to the continent code in queryURL responses
+	ErrorField              string            `json:"errorField,omitempty"`              // Dotted path that marks a failed queryURL response (e.g. "status")
+	ErrorValue              string            `json:"errorValue,omitempty"`              // Value of errorField meaning failure (default: any value but empty/false)
+	QueryHeaders            map[string]string `json:"queryHeaders,omitempty"`            // Headers sent to queryURL, values may use {token} (e.g. "Bearer {token}")
+	QueryTokenFile          string            `json:"queryTokenFile,omitempty"`          // File holding the {token} value for queryURL
+	QueryTokenEnv           string            `json:"queryTokenEnv,omitempty"`           // Environment variable holding the {token} value for queryURL
+	QueryRateLimit          int               `json:"queryRateLimit,omitempty"`          // queryURL lookups per minute allowed by the API quota (0: unlimited)
+	QueryRateBurst          int               `json:"queryRateBurst,omitempty"`          // queryURL lookups allowed at once on top of the rate (default: queryRateLimit)
+	QueryBreakerThreshold   int               `json:"queryBreakerThreshold,omitempty"`   // Consecutive queryURL failures that open the circuit breaker (default: 5, negative disables)
+	QueryBreakerCooldown    string            `json:"queryBreakerCooldown,omitempty"`    // How long the breaker stays open before probing queryURL again (default: "30s")
+	DatabaseURL             string            `json:"databaseURL,omitempty"`             // URL to download local database (e.g., https://ipinfo.io/data/ipinfo_lite.json.gz?token=TOKEN)
+	DatabasePath            string            `json:"databasePath,omitempty"`            // Path to store local database
+	DatabaseFormat          string            `json:"databaseFormat,omitempty"`          // "json", "mmdb", "dbip-csv", "ip2location-csv" or "geolite2-csv" (auto-detected when empty)
+	DatabaseLocationsPath   string            `json:"databaseLocationsPath,omitempty"`   // GeoLite2 locations CSV joined with geolite2-csv blocks
+	DatabaseChecksumURL     string            `json:"databaseChecksumURL,omitempty"`     // Optional SHA-256 sidecar URL verified against each download
+	DatabaseHeaders         map[string]string `json:"databaseHeaders,omitempty"`         // Headers sent with database downloads, values may use {token}
+	DatabaseTokenFile       string            `json:"databaseTokenFile,omitempty"`       // File holding the {token} value for databaseURL
+	DatabaseTokenEnv        string            `json:"databaseTokenEnv,omitempty"`        // Environment variable holding the {token} value for databaseURL
+	DatabaseMinRows         int               `json:"databaseMinRows,omitempty"`         // Reject databases with fewer ranges (default: 1)
+	DatabaseValidationIPs   []string          `json:"databaseValidationIPs,omitempty"`   // Sample IPs a new database must resolve before it is activated
+	DatabaseRefreshInterval string            `json:"databaseRefreshInterval,omitempty"` // How often to check databaseURL for a new database (default: "24h")
+	DatabaseWatchInterval   string            `json:"databaseWatchInterval,omitempty"`   // How often to poll databasePath for changes when no databaseURL is set (default: "30s")
+	OfflineMode             bool              `json:"offlineMode,omitempty"`             // Never make outbound calls: local database only, no queryURL fallback
+	ASNDatabasePath         string            `json:"asnDatabasePath,omitempty"`         // Optional ASN .mmdb merged into lookups (mmdb format only)
+	CacheDuration           int               `json:"cacheDuration,omitempty"`           // in minutes
+	CacheMaxEntries         int               `json:"cacheMaxEntries,omitempty"`         // Maximum number of cached lookups, least recently used are evicted (default: 100000)
+	CacheIPv4Prefix         int               `json:"cacheIPv4Prefix,omitempty"`         // Cache IPv4 answers per prefix of this length, e.g. 24 (default: 0, per address)
+	CacheIPv6Prefix         int               `json:"cacheIPv6Prefix,omitempty"`         // Cache IPv6 answers per prefix of this length, e.g. 48 (default: 0, per address)
+	CacheNegativeDuration   string            `json:"cacheNegativeDuration,omitempty"`   // How long failed lookups and UNKNOWN answers are cached (default: "1m", "0s" disables)
+	CacheStaleDuration      string            `json:"cacheStaleDuration,omitempty"`      // How long expired answers are still served while refreshed in the background (default: "0s", disabled)
+	CachePersistPath        string            `json:"cachePersistPath,omitempty"`        // File the cache is saved to and restored from across restarts (default: none)
+	CachePersistInterval    string            `json:"cachePersistInterval,omitempty"`    // How often the cache is saved to cachePersistPath (default: "5m")
+	DefaultAction           string            `json:"defaultAction,omitempty"`           // "allow" or "block"
+	BlockMessage            string            `json:"blockMessage,omitempty"`
+	BlockPageTitle          string            `json:"blockPageTitle,omitempty"`
+	BlockPageBody           string            `json:"blockPageBody,omitempty"`
+	RedirectURL             string            `json:"redirectURL,omitempty"`           // URL to redirect blocked users (optional)
+	LogBlocked              bool              `json:"logBlocked,omitempty"`            // Legacy logging (stdout with IPs)
+	TrustedProxies          []string          `json:"trustedProxies,omitempty"`        // IP addresses or CIDR ranges of trusted proxies
+	IPStrategy              IPStrategy        `json:"ipStrategy,omitempty"`            // Where the client address is read from (default: legacy X-Forwarded-For / X-Real-IP handling)
+	StrictClientIP          *bool             `json:"strictClientIP,omitempty"`        // Ignore forwarding headers unless RemoteAddr is a trusted proxy (default: true with configVersion 2)
+	Headers                 DownstreamHeaders `json:"headers,omitempty"`               // Names of the headers set for downstream services
+	SpecialAddressPolicy    map[string]string `json:"specialAddressPolicy,omitempty"`  // Special-purpose address category (PRIVATE, CGNAT, ...) to "country", "allow", "block" or "geolocate"
+	MetricsLogPath          string            `json:"metricsLogPath,omitempty"`        // Path for Grafana-compatible metrics logs (deprecated, use PrometheusMetricsPath)
+	MetricsFlushSeconds     int               `json:"metricsFlushSeconds,omitempty"`   // How often to flush metrics (default: 60)
+	LogRetentionDays        int               `json:"logRetentionDays,omitempty"`      // Days to retain logs (default: 14)
+	EnableMetricsLog        bool              `json:"enableMetricsLog,omitempty"`      // Enable Grafana-compatible logging (deprecated, use PrometheusMetricsPath)
+	PrometheusMetricsPath   string            `json:"prometheusMetricsPath,omitempty"` // Path to expose Prometheus metrics endpoint (e.g., "/__geoblock_metrics")
+	OrganizationSource      string            `json:"organizationSource,omitempty"`    // Organization for local database hits: "none", "localdb" (default) or "api-async"
+	Providers               []ProviderConfig  `json:"providers,omitempty"`             // Ordered lookup chain (default: local database, then queryURL)
+	HTTPTimeout             string            `json:"httpTimeout,omitempty"`           // Timeout of outbound API calls (default: "5s")
+	HTTPMaxIdleConns        int               `json:"httpMaxIdleConns,omitempty"`      // Kept-alive connections per host (default: 10)
+	HTTPCABundle            string            `json:"httpCABundle,omitempty"`          // PEM file with extra CAs trusted for outbound HTTPS
+	HTTPTLSServerName       string            `json:"httpTLSServerName,omitempty"`     // TLS server name to verify instead of the URL host
+	HTTPProxyURL            string            `json:"httpProxyURL,omitempty"`          // Outbound proxy (default: HTTPS_PROXY / HTTP_PROXY environment)
 }
 
 // CreateConfig creates the default plugin configuration
 func CreateConfig() *Config {
 	return &Config{
-		AllowedCountries:    []string{},
-		BlockedCountries:    []string{},
-		QueryURL:            "https://ipapi.co/{ip}/json/",
-		DatabaseURL:         "",
-		DatabasePath:        "/tmp/ipinfo_lite.json",
-		CacheDuration:       60,
-		DefaultAction:       DefaultActionAllow,
-		BlockMessage:        "Access denied from your country",
-		BlockPageTitle:      "Access Denied",
-		BlockPageBody:       "",
-		RedirectURL:         "",
-		LogBlocked:          true,
-		TrustedProxies:      []string{},
-		MetricsLogPath:      "/var/log/traefik-geoblock/metrics.log",
-		MetricsFlushSeconds: 60,
-		LogRetentionDays:    14,
-		EnableMetricsLog:    false,
+		AllowedCountries:        []string{},
+		BlockedCountries:        []string{},
+		QueryURL:                "https://ipapi.co/{ip}/json/",
+		DatabaseURL:             "",
+		DatabasePath:            "",
+		CacheDuration:           60,
+		CacheMaxEntries:         defaultCacheMaxEntries,
+		CacheNegativeDuration:   "1m",
+		CachePersistInterval:    "5m",
+		DefaultAction:           DefaultActionAllow,
+		BlockMessage:            "Access denied from your country",
+		BlockPageTitle:          "Access Denied",
+		BlockPageBody:           "",
+		RedirectURL:             "",
+		LogBlocked:              true,
+		TrustedProxies:          []string{},
+		Headers:                 DownstreamHeaders{Country: defaultCountryHeader, Organization: defaultOrganizationHeader},
+		MetricsLogPath:          "/var/log/traefik-geoblock/metrics.log",
+		MetricsFlushSeconds:     60,
+		LogRetentionDays:        14,
+		EnableMetricsLog:        false,
+		DatabaseMinRows:         1,
+		DatabaseRefreshInterval: "24h",
+		DatabaseWatchInterval:   "30s",
+		HTTPTimeout:             "5s",
+		HTTPMaxIdleConns:        defaultHTTPMaxIdleConns,
+		OrganizationSource:      OrganizationSourceLocalDB,
 	}
 }
 
@@ -83,52 +159,60 @@ type GeoBlock struct {
 	localDB           *localDatabase
 	allowedCountries  map[string]bool
 	blockedCountries  map[string]bool
-	trustedProxies    map[string]bool
+	trustedProxies    []*net.IPNet
+	strictClientIP    bool         // forwarding headers only count from trusted proxies
+	forwardingHeaders []string     // headers that can carry a client address
+	spoofLog          *tokenBucket // rate limits spoof attempt log lines
+	headers           DownstreamHeaders
+	specialPolicies   map[string]string // special-purpose address category to policy
+	specialAliases    map[string]string // special-purpose address category to the category reported
 	metricsAggregator *metricsAggregator
 	promMetrics       *prometheusMetrics
-}
+	enricher          *organizationEnricher
+	providers         []providerEntry
+	inflight          lookupGroup
+	httpClient        *http.Client // shared by all providers
 
-type geoCache struct {
-	mu      sync.RWMutex
-	entries map[string]*cacheEntry
+	negativeCacheDuration time.Duration // how long failures and UNKNOWN answers are cached
 }
 
-type cacheEntry struct {
-	country      string
-	organization string
-	expiresAt    time.Time
+// organizationEnricher tracks background organization lookups for api-async mode
+type organizationEnricher struct {
+	mu       sync.Mutex
+	pending  map[string]bool
+	slots    chan struct{} // bounds concurrent background lookups
+	provider providerEntry // queryURL
 }
 
 type localDatabase struct {
-	mu          sync.RWMutex
-	ranges      []ipRange
-	lastUpdate  time.Time
-	downloadURL string
-	filePath    string
-}
-
-type ipRange struct {
-	startIP net.IP
-	endIP   net.IP
-	country string
+	mu              sync.RWMutex
+	active          *databaseSnapshot
+	lastUpdate      time.Time // activation or last confirmation of the active generation
+	downloadURL     string
+	filePath        string
+	asnFilePath     string
+	locationsPath   string
+	format          string // empty means auto-detect
+	checksumURL     string
+	minRows         int
+	validationIPs   []net.IP
+	refreshInterval time.Duration
+	watchInterval   time.Duration
+	auth            requestAuth
+	client          *http.Client // for downloads, shares the providers' transport
 }
 
 type ipInfoLiteEntry struct {
-	StartIP string `json:"start_ip"`
-	EndIP   string `json:"end_ip"`
-	Country string `json:"country"`
-}
-
-type ipAPIResponse struct {
-	IP           string `json:"ip"`
-	Country      string `json:"country_code"` // ipapi.co format
-	CountryCode  string `json:"countryCode"`  // ip-api.com format
-	CountryISO   string `json:"country"`      // ipinfo.io format
-	CountryName  string `json:"country_name"`
-	Organization string `json:"org"`    // ipapi.co/ipinfo.io format
-	ISP          string `json:"isp"`    // ip-api.com format
-	AS           string `json:"as"`     // Alternative org format
-	ASName       string `json:"asname"` // Alternative org format
+	StartIP       string `json:"start_ip"`
+	EndIP         string `json:"end_ip"`
+	Network       string `json:"network"`
+	Country       string `json:"country"` // code in the legacy schema, name in the current one
+	CountryCode   string `json:"country_code"`
+	Continent     string `json:"continent"`
+	ContinentCode string `json:"continent_code"`
+	ASN           string `json:"asn"`
+	ASName        string `json:"as_name"`
+	ASDomain      string `json:"as_domain"`
 }
 
 // Metrics structures for Grafana-compatible logging
@@ -161,13 +245,20 @@ type metricLogEntry struct {
 type geoInfo struct {
 	Country      string
 	Organization string
+	Continent    string
+	ASN          uint32
+	ASDomain     string
+	Source       string     // name of the provider that answered
+	network      *net.IPNet // network sharing this answer, when the provider reports it
 }
 
 // Prometheus metrics structures for native Prometheus integration
 
 type prometheusMetrics struct {
-	mu       sync.RWMutex
-	counters map[string]int64 // key: "country|organization|action"
+	mu            sync.RWMutex
+	counters      map[string]int64 // key: "country|organization|action"
+	lookups       map[string]int64 // key: provider name
+	spoofAttempts map[string]int64 // key: header name
 }
 
 // New creates a new GeoBlock plugin
@@ -176,14 +267,104 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		config.QueryURL = "https://ipapi.co/{ip}/json/"
 	}
 
-	if config.DatabasePath == "" {
-		config.DatabasePath = "/tmp/ipinfo_lite.json"
+	if err := parseOrganizationSource(config); err != nil {
+		return nil, err
+	}
+	localDB, err := parseDatabaseOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	cacheOptions, err := parseCacheOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	clientIP, err := parseClientIPOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := config.Headers.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("invalid headers: %w", err)
+	}
+	specialPolicies, specialAliases, err := parseSpecialAddressPolicy(config.SpecialAddressPolicy,
+		config.ConfigVersion >= ConfigVersionCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	setResponseDefaults(config)
+
+	gb := &GeoBlock{
+		next:              next,
+		config:            config,
+		name:              name,
+		cache:             newGeoCache(config.CacheMaxEntries),
+		allowedCountries:  countrySet(config.AllowedCountries),
+		blockedCountries:  countrySet(config.BlockedCountries),
+		trustedProxies:    clientIP.trustedProxies,
+		strictClientIP:    clientIP.strict,
+		forwardingHeaders: forwardingHeaders(config.IPStrategy),
+		spoofLog:          newTokenBucket(spoofLogRate, spoofLogRate),
+		headers:           headers,
+		specialPolicies:   specialPolicies,
+		specialAliases:    specialAliases,
+	}
+	gb.cache.setPrefixLengths(config.CacheIPv4Prefix, config.CacheIPv6Prefix)
+	gb.cache.setStaleDuration(cacheOptions.staleDuration)
+	gb.negativeCacheDuration = cacheOptions.negativeDuration
+
+	httpClient, downloadClient, err := newHTTPClients(config)
+	if err != nil {
+		return nil, err
+	}
+	gb.httpClient = httpClient
+
+	providers, err := gb.buildProviders(config)
+	if err != nil {
+		return nil, err
+	}
+	gb.providers = providers
+
+	if config.OrganizationSource == OrganizationSourceAPIAsync {
+		if gb.enricher, err = gb.newOrganizationEnricher(config); err != nil {
+			return nil, err
+		}
+	}
+	if err := gb.initMetrics(ctx, config); err != nil {
+		return nil, err
 	}
 
-	if config.CacheDuration <= 0 {
-		config.CacheDuration = 60
+	// Initialize local database if configured. Without a URL the file is provisioned
+	// externally (volume mount, config management) and watched for replacements.
+	if config.DatabasePath != "" {
+		localDB.client = downloadClient
+		gb.localDB = localDB
+		gb.startLocalDatabase(ctx)
 	}
 
+	// This comes last so a rejected configuration never writes the cache snapshot
+	if config.CachePersistPath != "" {
+		gb.startCachePersistence(ctx, config.CachePersistPath, cacheOptions.persistInterval)
+	}
+
+	return gb, nil
+}
+
+// parseOrganizationSource normalizes organizationSource, which defaults to localdb
+func parseOrganizationSource(config *Config) error {
+	config.OrganizationSource = strings.ToLower(config.OrganizationSource)
+	switch config.OrganizationSource {
+	case "":
+		config.OrganizationSource = OrganizationSourceLocalDB
+	case OrganizationSourceNone, OrganizationSourceLocalDB, OrganizationSourceAPIAsync:
+	default:
+		return fmt.Errorf("unsupported organizationSource %q", config.OrganizationSource)
+	}
+	return nil
+}
+
+// setResponseDefaults fills in the default action and block page options
+func setResponseDefaults(config *Config) {
 	if config.DefaultAction != DefaultActionAllow && config.DefaultAction != "block" {
 		config.DefaultAction = DefaultActionAllow
 	}
@@ -195,80 +376,186 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 	if config.BlockPageTitle == "" {
 		config.BlockPageTitle = "Access Denied"
 	}
+}
 
-	// Create maps for faster lookup
-	allowedCountries := make(map[string]bool)
-	for _, country := range config.AllowedCountries {
-		allowedCountries[strings.ToUpper(country)] = true
+// parseDatabaseOptions validates the local database options, filling in their
+// defaults, and returns the database they describe
+func parseDatabaseOptions(config *Config) (*localDatabase, error) {
+	if err := parseDatabaseLocation(config); err != nil {
+		return nil, err
 	}
 
-	blockedCountries := make(map[string]bool)
-	for _, country := range config.BlockedCountries {
-		blockedCountries[strings.ToUpper(country)] = true
+	if config.DatabaseMinRows <= 0 {
+		config.DatabaseMinRows = 1
 	}
 
-	trustedProxies := make(map[string]bool)
-	for _, proxy := range config.TrustedProxies {
-		trustedProxies[proxy] = true
+	if config.DatabaseRefreshInterval == "" {
+		config.DatabaseRefreshInterval = "24h"
+	}
+	refreshInterval, err := time.ParseDuration(config.DatabaseRefreshInterval)
+	if err != nil || refreshInterval <= 0 {
+		return nil, fmt.Errorf("invalid databaseRefreshInterval %q", config.DatabaseRefreshInterval)
 	}
 
-	gb := &GeoBlock{
-		next:             next,
-		config:           config,
-		name:             name,
-		cache:            &geoCache{entries: make(map[string]*cacheEntry)},
-		allowedCountries: allowedCountries,
-		blockedCountries: blockedCountries,
-		trustedProxies:   trustedProxies,
+	if config.DatabaseWatchInterval == "" {
+		config.DatabaseWatchInterval = "30s"
+	}
+	watchInterval, err := time.ParseDuration(config.DatabaseWatchInterval)
+	if err != nil || watchInterval <= 0 {
+		return nil, fmt.Errorf("invalid databaseWatchInterval %q", config.DatabaseWatchInterval)
 	}
 
-	// Initialize Prometheus metrics if path is configured
-	if config.PrometheusMetricsPath != "" {
-		gb.promMetrics = &prometheusMetrics{
-			counters: make(map[string]int64),
-		}
-		fmt.Printf("[GeoBlock] Prometheus metrics enabled at path: %s\n", config.PrometheusMetricsPath)
+	auth, err := newRequestAuth(config.DatabaseHeaders, config.DatabaseTokenFile, config.DatabaseTokenEnv,
+		config.DatabaseURL, config.DatabaseChecksumURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database credentials: %w", err)
 	}
 
-	// Initialize metrics aggregator if enabled (legacy JSON logging)
-	if config.EnableMetricsLog {
-		if config.MetricsFlushSeconds <= 0 {
-			config.MetricsFlushSeconds = 60
-		}
-		if config.LogRetentionDays <= 0 {
-			config.LogRetentionDays = 14
+	validationIPs := make([]net.IP, 0, len(config.DatabaseValidationIPs))
+	for _, ip := range config.DatabaseValidationIPs {
+		parsedIP := net.ParseIP(strings.TrimSpace(ip))
+		if parsedIP == nil {
+			return nil, fmt.Errorf("invalid databaseValidationIPs entry %q", ip)
 		}
+		validationIPs = append(validationIPs, parsedIP)
+	}
+
+	return &localDatabase{
+		downloadURL:     config.DatabaseURL,
+		filePath:        config.DatabasePath,
+		asnFilePath:     config.ASNDatabasePath,
+		locationsPath:   config.DatabaseLocationsPath,
+		format:          config.DatabaseFormat,
+		checksumURL:     config.DatabaseChecksumURL,
+		minRows:         config.DatabaseMinRows,
+		validationIPs:   validationIPs,
+		refreshInterval: refreshInterval,
+		watchInterval:   watchInterval,
+		auth:            auth,
+	}, nil
+}
 
-		aggregator, err := newMetricsAggregator(config.MetricsLogPath, config.MetricsFlushSeconds, config.LogRetentionDays)
-		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metrics aggregator: %w", err)
+// parseDatabaseLocation validates the format and source of the local database.
+// The configured database is checked before any default path is filled in.
+func parseDatabaseLocation(config *Config) error {
+	config.DatabaseFormat = strings.ToLower(config.DatabaseFormat)
+	if !isValidDatabaseFormat(config.DatabaseFormat) {
+		return fmt.Errorf("unsupported databaseFormat %q", config.DatabaseFormat)
+	}
+
+	if config.OfflineMode {
+		switch {
+		case config.DatabasePath == "":
+			return errors.New("offlineMode requires databasePath")
+		case config.DatabaseURL != "" || config.DatabaseChecksumURL != "":
+			return errors.New("offlineMode cannot be combined with databaseURL or databaseChecksumURL")
+		case config.OrganizationSource == OrganizationSourceAPIAsync:
+			return fmt.Errorf("offlineMode cannot be combined with organizationSource %q", OrganizationSourceAPIAsync)
+		}
+	}
+	if config.DatabasePath == "" {
+		switch {
+		case config.DatabaseURL != "":
+			// Downloads need somewhere to go; a file-only database has to be named
+			config.DatabasePath = "/tmp/ipinfo_lite.json"
+		case config.DatabaseFormat != "":
+			return errors.New("databaseFormat requires databasePath or databaseURL")
 		}
-		gb.metricsAggregator = aggregator
+	}
+	return nil
+}
 
-		// Start background flusher
-		go gb.metricsAggregator.startFlusher(ctx)
+// countrySet builds the lookup set of a country list
+func countrySet(countries []string) map[string]bool {
+	set := make(map[string]bool, len(countries))
+	for _, country := range countries {
+		set[strings.ToUpper(country)] = true
 	}
+	return set
+}
 
-	// Initialize local database if configured
-	if config.DatabaseURL != "" {
-		gb.localDB = &localDatabase{
-			downloadURL: config.DatabaseURL,
-			filePath:    config.DatabasePath,
-			ranges:      make([]ipRange, 0),
+// newOrganizationEnricher sets up the background organization lookups of api-async mode
+func (g *GeoBlock) newOrganizationEnricher(config *Config) (*organizationEnricher, error) {
+	enricher := &organizationEnricher{
+		pending: make(map[string]bool),
+		slots:   make(chan struct{}, 8),
+	}
+	var err error
+	if enricher.provider, err = g.newProvider(queryProviderConfig(config), config); err != nil {
+		return nil, fmt.Errorf("invalid queryURL: %w", err)
+	}
+
+	// Share quota and breaker with the chain when it queries the same API
+	for _, entry := range g.providers {
+		if provider, ok := entry.provider.(*httpJSONProvider); ok && provider.url == config.QueryURL {
+			enricher.provider = entry
+			break
 		}
+	}
+	return enricher, nil
+}
 
-		// Initial database load
-		if err := gb.loadLocalDatabase(); err != nil {
-			fmt.Printf("[GeoBlock] Warning: Failed to load local database: %v. Will use query API as fallback.\n", err)
-		} else {
-			fmt.Printf("[GeoBlock] Local database loaded successfully with %d IP ranges\n", len(gb.localDB.ranges))
+// initMetrics sets up the Prometheus counters and the legacy JSON metrics log
+func (g *GeoBlock) initMetrics(ctx context.Context, config *Config) error {
+	// Initialize Prometheus metrics if path is configured
+	if config.PrometheusMetricsPath != "" {
+		g.promMetrics = &prometheusMetrics{
+			counters:      make(map[string]int64),
+			lookups:       make(map[string]int64),
+			spoofAttempts: make(map[string]int64),
 		}
+		fmt.Printf("[GeoBlock] Prometheus metrics enabled at path: %s\n", config.PrometheusMetricsPath)
+	}
 
-		// Start background updater
-		go gb.databaseUpdater(ctx)
+	// Initialize metrics aggregator if enabled (legacy JSON logging)
+	if !config.EnableMetricsLog {
+		return nil
+	}
+	if config.MetricsFlushSeconds <= 0 {
+		config.MetricsFlushSeconds = 60
+	}
+	if config.LogRetentionDays <= 0 {
+		config.LogRetentionDays = 14
 	}
 
-	return gb, nil
+	aggregator, err := newMetricsAggregator(config.MetricsLogPath, config.MetricsFlushSeconds, config.LogRetentionDays)
+	if err != nil {
+		return fmt.Errorf("failed to initialize metrics aggregator: %w", err)
+	}
+	g.metricsAggregator = aggregator
+
+	// Start background flusher
+	go g.metricsAggregator.startFlusher(ctx)
+	return nil
+}
+
+// startLocalDatabase loads the local database and starts its updater, or its
+// file watcher when there is nothing to download
+func (g *GeoBlock) startLocalDatabase(ctx context.Context) {
+	// Initial database load
+	if err := g.loadLocalDatabase(); err != nil {
+		fmt.Printf("[GeoBlock] Warning: Failed to load local database: %v. Will use query API as fallback.\n", err)
+	} else {
+		fmt.Printf("[GeoBlock] Local database loaded successfully with %d IP ranges\n", g.localDB.size())
+	}
+
+	// Start background updater
+	if g.localDB.downloadURL != "" {
+		go g.databaseUpdater(ctx)
+	} else {
+		go g.databaseWatcher(ctx)
+	}
+}
+
+// startCachePersistence restores the cache of the previous run from path, then
+// keeps the snapshot there current
+func (g *GeoBlock) startCachePersistence(ctx context.Context, path string, interval time.Duration) {
+	if count, err := g.cache.load(path); err != nil {
+		fmt.Printf("[GeoBlock] Warning: Failed to restore cache: %v\n", err)
+	} else if count > 0 {
+		fmt.Printf("[GeoBlock] Restored %d cache entries from %s\n", count, path)
+	}
+	go g.cache.persist(ctx, path, interval)
 }
 
 func (g *GeoBlock) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -278,8 +565,12 @@ func (g *GeoBlock) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Backends trust these headers, so client-supplied values never pass through
+	g.headers.strip(req)
+
 	ip := g.getClientIP(req)
 	if ip == "" {
+		g.headers.set(req, nil, DecisionDefault)
 		g.next.ServeHTTP(rw, req)
 		return
 	}
@@ -295,6 +586,7 @@ func (g *GeoBlock) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			g.recordMetrics(CountryUnknown, "", "blocked")
 			return
 		}
+		g.headers.set(req, nil, DecisionDefault)
 		g.next.ServeHTTP(rw, req)
 		return
 	}
@@ -308,172 +600,169 @@ func (g *GeoBlock) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// Record allowed metric
 	g.recordMetrics(geoInfo.Country, geoInfo.Organization, "allowed")
 
-	// Add country header for downstream services
-	req.Header.Set("X-Country-Code", geoInfo.Country)
-	if geoInfo.Organization != "" {
-		req.Header.Set("X-Organization", geoInfo.Organization)
-	}
+	// Add country headers for downstream services
+	g.headers.set(req, geoInfo, DecisionAllowed)
 	g.next.ServeHTTP(rw, req)
 }
 
-func (g *GeoBlock) getClientIP(req *http.Request) string {
-	// Check X-Forwarded-For header
-	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		// Get the first non-trusted proxy IP
-		for _, ip := range ips {
-			ip = strings.TrimSpace(ip)
-			if !g.trustedProxies[ip] && net.ParseIP(ip) != nil {
-				return ip
-			}
-		}
-	}
-
-	// Check X-Real-IP header
-	if xri := req.Header.Get("X-Real-IP"); xri != "" {
-		return strings.TrimSpace(xri)
-	}
+func (g *GeoBlock) getGeoInfo(ip string) (*geoInfo, error) {
+	ip = normalizeIP(ip)
 
-	// Fall back to RemoteAddr
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return req.RemoteAddr
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
 	}
-	return host
-}
 
-func (g *GeoBlock) getGeoInfo(ip string) (*geoInfo, error) {
-	// Check if it's a private/local IP
-	if g.isPrivateIP(ip) {
-		return &geoInfo{Country: "PRIVATE", Organization: ""}, nil
+	// Special-purpose addresses report their category as the country, unless
+	// they carry an IPv4 address that is geolocated instead
+	if special := lookupSpecialRange(parsedIP); special != nil {
+		category := special.category
+		if alias, ok := g.specialAliases[category]; ok {
+			category = alias
+		}
+		if g.specialPolicies[category] != SpecialPolicyGeolocate {
+			return &geoInfo{Country: category}, nil
+		}
+		return g.getGeoInfo(special.embedded(parsedIP).String())
 	}
 
-	// Check cache first
-	if info := g.cache.get(ip); info != nil {
-		return info, nil
+	// Check cache first; stale answers are served while one request refreshes them
+	if hit, ok := g.cache.getAddress(parsedIP); ok {
+		if hit.refresh {
+			go g.refreshGeoInfo(ip, parsedIP, hit.key)
+		}
+		return hit.result()
 	}
 
-	var info *geoInfo
-	var err error
+	// Concurrent misses for the same IP share one lookup
+	return g.inflight.do(ip, func() (*geoInfo, error) {
+		return g.lookupGeoInfo(ip, parsedIP)
+	})
+}
 
-	// Use local database if available
-	if g.localDB != nil && len(g.localDB.ranges) > 0 {
-		country := g.lookupLocalDatabase(ip)
-		if country != "" && country != CountryUnknown {
-			info = &geoInfo{Country: country, Organization: ""}
-			// Try to get organization from API
-			if apiInfo, apiErr := g.queryGeoIP(ip); apiErr == nil {
-				info.Organization = apiInfo.Organization
-			}
-			g.cache.set(ip, info, time.Duration(g.config.CacheDuration)*time.Minute)
-			return info, nil
-		}
+// lookupGeoInfo resolves ip through the providers and caches the answer, or
+// the failure for cacheNegativeDuration
+func (g *GeoBlock) lookupGeoInfo(ip string, parsedIP net.IP) (*geoInfo, error) {
+	// A lookup that finished just before this one started already cached the answer
+	if hit, ok := g.cache.findAddress(parsedIP); ok && !hit.stale {
+		return hit.result()
 	}
 
-	// Fallback to API query
-	info, err = g.queryGeoIP(ip)
+	// Ask the providers in order
+	info, local, err := g.resolveGeoInfo(ip)
 	if err != nil {
+		// A rate limit rejection is local back-pressure, not an answer about ip
+		if g.negativeCacheDuration > 0 && !errors.Is(err, errRateLimited) {
+			g.cache.setAddressError(parsedIP, err, g.negativeCacheDuration)
+		}
 		return nil, err
 	}
 
-	// Cache the result
-	g.cache.set(ip, info, time.Duration(g.config.CacheDuration)*time.Minute)
-
+	g.storeGeoInfo(ip, parsedIP, info, local)
 	return info, nil
 }
 
-func (g *GeoBlock) queryGeoIP(ip string) (*geoInfo, error) {
-	url := strings.Replace(g.config.QueryURL, "{ip}", ip, 1)
-
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query geo IP: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("geo IP API returned status %d", resp.StatusCode)
+// refreshGeoInfo replaces the stale cache entry under key. When the lookup
+// fails or no provider knows the address any more, the stale answer is kept, so
+// an outage does not flip decisions, and the refresh is retried after
+// cacheNegativeDuration.
+func (g *GeoBlock) refreshGeoInfo(ip string, parsedIP net.IP, key string) {
+	info, local, err := g.resolveGeoInfo(ip)
+	if err == nil && info.Country == CountryUnknown {
+		err = errors.New("no provider knows the address")
 	}
-
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		if g.config.LogBlocked {
+			fmt.Printf("[GeoBlock] Failed to refresh cached country for IP %s, serving stale answer: %v\n", ip, err)
+		}
+		g.cache.refreshFailed(key, g.negativeCacheDuration)
+		return
 	}
 
-	var data ipAPIResponse
-	if err := json.Unmarshal(body, &data); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+	// The answer may be cached under another network, or not at all; release
+	// the stale entry so it is refreshed again instead of staying claimed
+	if g.storeGeoInfo(ip, parsedIP, info, local) != key {
+		g.cache.refreshFailed(key, g.negativeCacheDuration)
 	}
+}
 
-	// Try different field names used by various GeoIP APIs
-	country := data.Country // ipapi.co: country_code
-	if country == "" {
-		country = data.CountryCode // ip-api.com: countryCode
-	}
-	if country == "" {
-		country = data.CountryISO // ipinfo.io: country
+// storeGeoInfo caches a resolved answer and returns its key, or "" when it was
+// not cached. UNKNOWN answers are kept for cacheNegativeDuration only.
+func (g *GeoBlock) storeGeoInfo(ip string, parsedIP net.IP, info *geoInfo, local bool) string {
+	if local && g.config.OrganizationSource == OrganizationSourceNone {
+		info.Organization = ""
 	}
 
-	if country == "" {
-		// Log the raw response for debugging
-		if g.config.LogBlocked {
-			fmt.Printf("[GeoBlock] Warning: Could not extract country from API response. Raw response: %s\n", string(body))
-		}
-		return &geoInfo{Country: CountryUnknown, Organization: ""}, nil
+	duration := time.Duration(g.config.CacheDuration) * time.Minute
+	if info.Country == CountryUnknown {
+		duration = g.negativeCacheDuration
 	}
-
-	// Extract organization information
-	organization := data.Organization
-	if organization == "" {
-		organization = data.ISP
+	if duration <= 0 {
+		return ""
 	}
-	if organization == "" {
-		organization = data.ASName
+
+	// Never block the request on the API: fill the organization in later. The
+	// organization found for ip need not apply to the rest of the matched
+	// network, so the answer is cached per address or configured prefix.
+	enrich := local && info.Organization == "" && g.enricher != nil
+	if enrich {
+		info.network = nil
 	}
-	if organization == "" {
-		organization = data.AS
+	key := g.cache.setAddress(parsedIP, info, duration)
+	if enrich {
+		g.enrichOrganization(ip, key)
 	}
-
-	return &geoInfo{
-		Country:      strings.ToUpper(country),
-		Organization: organization,
-	}, nil
+	return key
 }
 
-func (g *GeoBlock) isPrivateIP(ip string) bool {
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return false
-	}
+// enrichOrganization queries the API in the background and stores the
+// organization in the cache entry for ip, cached under key. Lookups already in
+// flight for the same IP are not repeated, and requests are dropped when all
+// slots are busy.
+func (g *GeoBlock) enrichOrganization(ip, key string) {
+	e := g.enricher
 
-	// Check for private IP ranges
-	privateRanges := []string{
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-		"127.0.0.0/8",
-		"::1/128",
-		"fc00::/7",
-		"fe80::/10",
+	e.mu.Lock()
+	if e.pending[ip] {
+		e.mu.Unlock()
+		return
 	}
-
-	for _, cidr := range privateRanges {
-		_, network, err := net.ParseCIDR(cidr)
-		if err != nil {
-			continue
-		}
-		if network.Contains(parsedIP) {
-			return true
-		}
+	select {
+	case e.slots <- struct{}{}:
+	default:
+		e.mu.Unlock()
+		return
 	}
+	e.pending[ip] = true
+	e.mu.Unlock()
 
-	return false
+	go func() {
+		defer func() {
+			e.mu.Lock()
+			delete(e.pending, ip)
+			e.mu.Unlock()
+			<-e.slots
+		}()
+
+		apiInfo, err := e.provider.lookup(net.ParseIP(ip))
+		if err != nil || apiInfo.Organization == "" {
+			return
+		}
+		g.cache.setOrganization(key, apiInfo.Organization)
+	}()
 }
 
 func (g *GeoBlock) shouldBlock(country string) bool {
 	country = strings.ToUpper(country)
 
+	// Special-purpose address categories may bypass the country lists
+	switch g.specialPolicies[country] {
+	case SpecialPolicyAllow:
+		return false
+	case SpecialPolicyBlock:
+		return true
+	}
+
 	// If allowed countries list is specified, only allow those
 	if len(g.allowedCountries) > 0 {
 		return !g.allowedCountries[country]
@@ -641,10 +930,14 @@ func getDefaultBlockPageStyles() string {
 // Local database functions
 
 func (g *GeoBlock) loadLocalDatabase() error {
+	if g.localDB.downloadURL == "" {
+		return g.loadDatabaseFromFile()
+	}
+
 	// Try to load from existing file first
 	if err := g.loadDatabaseFromFile(); err == nil {
-		// Check if database is recent (less than 24 hours old)
-		if time.Since(g.localDB.lastUpdate) < 24*time.Hour {
+		// Check if database is recent (downloaded or confirmed within the refresh interval)
+		if time.Since(g.localDB.lastUpdated()) < g.localDB.refreshInterval {
 			return nil
 		}
 	}
@@ -653,215 +946,250 @@ func (g *GeoBlock) loadLocalDatabase() error {
 	return g.downloadDatabase()
 }
 
+// loadDatabaseFromFile activates the database stored on disk. If that file is
+// missing or fails validation, the previous generation is used instead.
 func (g *GeoBlock) loadDatabaseFromFile() error {
-	g.localDB.mu.Lock()
-	defer g.localDB.mu.Unlock()
-
-	file, err := os.Open(g.localDB.filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open database file: %w", err)
+	snapshot, err := g.localDB.readSnapshot(g.localDB.filePath)
+	if err == nil {
+		err = g.localDB.validate(snapshot)
 	}
-	defer file.Close()
-
-	// Get file modification time
-	stat, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to stat database file: %w", err)
+		previous, prevErr := g.localDB.readSnapshot(g.localDB.filePath + previousSuffix)
+		if prevErr != nil || g.localDB.validate(previous) != nil {
+			return err
+		}
+		fmt.Printf("[GeoBlock] Warning: Database file is unusable (%v), rolled back to previous generation\n", err)
+		snapshot = previous
+
+		// The validators belong to the unusable file; revalidating them would
+		// confirm it instead of downloading the database again
+		if err := os.Remove(g.localDB.filePath + metadataSuffix); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[GeoBlock] Warning: Failed to remove database metadata: %v\n", err)
+		}
 	}
-	g.localDB.lastUpdate = stat.ModTime()
 
-	decoder := json.NewDecoder(file)
-	var entries []ipInfoLiteEntry
+	g.localDB.activate(snapshot)
+	return nil
+}
 
-	if err := decoder.Decode(&entries); err != nil {
-		return fmt.Errorf("failed to decode database: %w", err)
+// reloadDatabaseFile activates the database file on disk if it is valid. Unlike
+// loadDatabaseFromFile it never rolls back: on failure the active database stays.
+func (g *GeoBlock) reloadDatabaseFile() error {
+	snapshot, err := g.localDB.readSnapshot(g.localDB.filePath)
+	if err == nil {
+		err = g.localDB.validate(snapshot)
 	}
-
-	// Convert to IP ranges
-	g.localDB.ranges = make([]ipRange, 0, len(entries))
-	for _, entry := range entries {
-		startIP := net.ParseIP(entry.StartIP)
-		endIP := net.ParseIP(entry.EndIP)
-		if startIP != nil && endIP != nil {
-			g.localDB.ranges = append(g.localDB.ranges, ipRange{
-				startIP: startIP,
-				endIP:   endIP,
-				country: strings.ToUpper(entry.Country),
-			})
-		}
+	if err != nil {
+		return err
 	}
 
+	g.localDB.activate(snapshot)
 	return nil
 }
 
+// downloadDatabase fetches a new database generation, verifies it (checksum,
+// minimum size, sample IP coverage) and atomically replaces the file on disk.
+// On any failure the currently active database is left untouched. When the
+// provider reports the database as unchanged, nothing is downloaded or parsed.
 func (g *GeoBlock) downloadDatabase() error {
-	fmt.Printf("[GeoBlock] Downloading database from %s\n", g.localDB.downloadURL)
+	fmt.Printf("[GeoBlock] Downloading database from %s\n", g.localDB.auth.redactURL(g.localDB.downloadURL))
 
-	client := &http.Client{Timeout: 5 * time.Minute}
-	resp, err := client.Get(g.localDB.downloadURL)
+	metadataPath := g.localDB.filePath + metadataSuffix
+	req, err := g.newDatabaseRequest(metadataPath)
 	if err != nil {
-		return fmt.Errorf("failed to download database: %w", err)
+		return err
+	}
+
+	client := g.localDB.client
+	if client == nil {
+		client = &http.Client{Timeout: databaseDownloadTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download database: %w", g.localDB.auth.redactError(err))
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		g.localDB.touch(time.Now())
+		fmt.Println("[GeoBlock] Database not modified since last download")
+		return nil
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("database download returned status %d", resp.StatusCode)
 	}
 
-	// Create temporary file
-	tmpFile, err := os.CreateTemp("", "ipinfo_lite_*.json.gz")
+	snapshot, err := g.installDownload(client, resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return err
+	}
+
+	snapshot.modTime = time.Now()
+	g.localDB.activate(snapshot)
+
+	metadata := databaseMetadata{
+		URL:          g.localDB.downloadURL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if err := writeDatabaseMetadata(metadataPath, metadata); err != nil {
+		fmt.Printf("[GeoBlock] Warning: Failed to save database metadata: %v\n", err)
+	}
+
+	fmt.Printf("[GeoBlock] Database downloaded and loaded successfully with %d IP ranges\n", snapshot.size())
+	return nil
+}
+
+// newDatabaseRequest builds the download request, conditional on the validators
+// saved in metadataPath
+func (g *GeoBlock) newDatabaseRequest(metadataPath string) (*http.Request, error) {
+	req, err := g.localDB.auth.newRequest(context.Background(), g.localDB.downloadURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only revalidate the generation we actually hold, never an empty or foreign one
+	if metadata := readDatabaseMetadata(metadataPath); metadata.URL == g.localDB.downloadURL && g.localDB.size() > 0 {
+		if metadata.ETag != "" {
+			req.Header.Set("If-None-Match", metadata.ETag)
+		}
+		if metadata.LastModified != "" {
+			req.Header.Set("If-Modified-Since", metadata.LastModified)
+		}
+	}
+	return req, nil
+}
+
+// installDownload saves body, verifies and unpacks it, and installs it at
+// databasePath once it passes validation. It returns the parsed generation,
+// which the caller still has to activate.
+func (g *GeoBlock) installDownload(client *http.Client, body io.Reader) (*databaseSnapshot, error) {
+	// Download next to the database file so the final rename stays on one filesystem
+	if err := os.MkdirAll(filepath.Dir(g.localDB.filePath), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(g.localDB.filePath), filepath.Base(g.localDB.filePath)+".download-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
 	defer os.Remove(tmpFile.Name())
 	defer tmpFile.Close()
 
-	// Download to temp file
-	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
-		return fmt.Errorf("failed to save database: %w", err)
+	// Download to temp file, hashing on the way for checksum verification
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hash), body); err != nil {
+		return nil, fmt.Errorf("failed to save database: %w", err)
+	}
+
+	if g.localDB.checksumURL != "" {
+		expected, err := fetchChecksum(client, g.localDB.auth, g.localDB.checksumURL)
+		if err != nil {
+			return nil, err
+		}
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+			return nil, fmt.Errorf("database checksum mismatch: got %s, expected %s", actual, expected)
+		}
 	}
 
 	// Reopen for reading
 	if _, err := tmpFile.Seek(0, 0); err != nil {
-		return fmt.Errorf("failed to seek temp file: %w", err)
+		return nil, fmt.Errorf("failed to seek temp file: %w", err)
 	}
 
-	// Decompress gzip
-	gzReader, err := gzip.NewReader(tmpFile)
+	// Decompress / extract the database as shipped by the provider
+	src, closeSrc, err := unpackDownload(tmpFile)
+	defer closeSrc()
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
-	}
-	defer gzReader.Close()
-
-	// Parse JSON
-	var entries []ipInfoLiteEntry
-	decoder := json.NewDecoder(gzReader)
-	if err := decoder.Decode(&entries); err != nil {
-		return fmt.Errorf("failed to decode database: %w", err)
-	}
-
-	// Convert to IP ranges and update database
-	g.localDB.mu.Lock()
-	g.localDB.ranges = make([]ipRange, 0, len(entries))
-	for _, entry := range entries {
-		startIP := net.ParseIP(entry.StartIP)
-		endIP := net.ParseIP(entry.EndIP)
-		if startIP != nil && endIP != nil {
-			g.localDB.ranges = append(g.localDB.ranges, ipRange{
-				startIP: startIP,
-				endIP:   endIP,
-				country: strings.ToUpper(entry.Country),
-			})
-		}
+		return nil, err
 	}
-	g.localDB.lastUpdate = time.Now()
-	g.localDB.mu.Unlock()
 
-	// Save to persistent file (uncompressed JSON for faster loading)
-	outFile, err := os.Create(g.localDB.filePath)
+	// Save uncompressed for faster loading, but only install it once it is known to be good
+	staged, err := stageDatabaseFile(g.localDB.filePath, src)
 	if err != nil {
-		return fmt.Errorf("failed to create database file: %w", err)
+		return nil, err
 	}
-	defer outFile.Close()
+	defer os.Remove(staged)
 
-	encoder := json.NewEncoder(outFile)
-	if err := encoder.Encode(entries); err != nil {
-		return fmt.Errorf("failed to save database: %w", err)
+	snapshot, err := g.localDB.readSnapshot(staged)
+	if err == nil {
+		err = g.localDB.validate(snapshot)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rejected downloaded database: %w", err)
 	}
 
-	fmt.Printf("[GeoBlock] Database downloaded and loaded successfully with %d IP ranges\n", len(g.localDB.ranges))
-	return nil
+	// Only the active, validated file becomes the previous generation; after a
+	// rollback the file on disk is the unusable one
+	keepCurrent := g.localDB.current().path == g.localDB.filePath
+	if err := installDatabaseFile(staged, g.localDB.filePath, keepCurrent); err != nil {
+		return nil, err
+	}
+	snapshot.path = g.localDB.filePath
+	return snapshot, nil
 }
 
+// databaseUpdater refreshes the database once per refresh interval. Each wait is
+// jittered so instances started together do not hit the provider at the same time.
 func (g *GeoBlock) databaseUpdater(ctx context.Context) {
-	ticker := time.NewTicker(24 * time.Hour)
-	defer ticker.Stop()
+	timer := time.NewTimer(nextRefreshDelay(g.localDB.lastUpdated(), g.localDB.refreshInterval))
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			fmt.Println("[GeoBlock] Starting daily database update...")
+		case <-timer.C:
+			fmt.Println("[GeoBlock] Starting scheduled database update...")
 			if err := g.downloadDatabase(); err != nil {
 				fmt.Printf("[GeoBlock] Failed to update database: %v\n", err)
 			}
+			timer.Reset(nextRefreshDelay(g.localDB.lastUpdated(), g.localDB.refreshInterval))
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (g *GeoBlock) lookupLocalDatabase(ip string) string {
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return CountryUnknown
-	}
+// databaseWatcher reloads the database when the file at databasePath is
+// replaced. The file is polled because inotify-style APIs are not available to
+// plugins; a replacement that fails validation is ignored.
+func (g *GeoBlock) databaseWatcher(ctx context.Context) {
+	ticker := time.NewTicker(g.localDB.watchInterval)
+	defer ticker.Stop()
 
-	g.localDB.mu.RLock()
-	defer g.localDB.mu.RUnlock()
+	watch := &databaseFileWatch{}
+	watch.seen, _ = os.Stat(g.localDB.filePath)
 
-	// Binary search would be faster, but for simplicity using linear search
-	// In production, consider sorting ranges and using binary search
-	for _, r := range g.localDB.ranges {
-		if ipInRange(parsedIP, r.startIP, r.endIP) {
-			return r.country
+	for {
+		select {
+		case <-ticker.C:
+			stat, err := os.Stat(g.localDB.filePath)
+			if err != nil || !watch.changed(stat) {
+				continue
+			}
+			if err := g.reloadDatabaseFile(); err != nil {
+				fmt.Printf("[GeoBlock] Warning: Ignoring changed database file: %v\n", err)
+				continue
+			}
+			fmt.Printf("[GeoBlock] Database file changed, reloaded with %d IP ranges\n", g.localDB.size())
+		case <-ctx.Done():
+			return
 		}
 	}
-
-	return CountryUnknown
-}
-
-func ipInRange(ip, start, end net.IP) bool {
-	// Convert to 16-byte format for comparison
-	ip = ip.To16()
-	start = start.To16()
-	end = end.To16()
-
-	if ip == nil || start == nil || end == nil {
-		return false
-	}
-
-	// Compare bytes
-	return bytes.Compare(ip, start) >= 0 && bytes.Compare(ip, end) <= 0
 }
 
-func (c *geoCache) get(ip string) *geoInfo {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	entry, exists := c.entries[ip]
-	if !exists {
-		return nil
-	}
-
-	if time.Now().After(entry.expiresAt) {
+// lookupLocalDatabase returns the local database answer for ip, or nil when the
+// address is not covered or has no country
+func (g *GeoBlock) lookupLocalDatabase(ip string) *geoInfo {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
 		return nil
 	}
 
-	return &geoInfo{
-		Country:      entry.country,
-		Organization: entry.organization,
-	}
+	return g.localDB.current().lookup(parsedIP)
 }
 
-func (c *geoCache) set(ip string, info *geoInfo, duration time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	c.entries[ip] = &cacheEntry{
-		country:      info.Country,
-		organization: info.Organization,
-		expiresAt:    time.Now().Add(duration),
-	}
-
-	// Simple cleanup: remove expired entries periodically
-	if len(c.entries) > 10000 {
-		now := time.Now()
-		for key, entry := range c.entries {
-			if now.After(entry.expiresAt) {
-				delete(c.entries, key)
-			}
-		}
-	}
+func (db *localDatabase) size() int {
+	return db.current().size()
 }
 
 // Metrics aggregator implementation for Grafana-compatible logging
@@ -1029,6 +1357,33 @@ func (g *GeoBlock) recordMetrics(country, organization, action string) {
 	}
 }
 
+// recordLookup counts a provider chain resolution by the provider that answered
+func (g *GeoBlock) recordLookup(provider string) {
+	if g.promMetrics != nil {
+		g.promMetrics.incrementLookup(provider)
+	}
+}
+
+func (pm *prometheusMetrics) incrementLookup(provider string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.lookups[provider]++
+}
+
+func (g *GeoBlock) recordSpoofAttempt(header string) {
+	if g.promMetrics != nil {
+		g.promMetrics.incrementSpoofAttempt(header)
+	}
+}
+
+func (pm *prometheusMetrics) incrementSpoofAttempt(header string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.spoofAttempts[header]++
+}
+
 func (pm *prometheusMetrics) increment(country, organization, action string) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
@@ -1043,7 +1398,7 @@ func (g *GeoBlock) servePrometheusMetrics(rw http.ResponseWriter) {
 		return
 	}
 
-	metrics := g.promMetrics.render()
+	metrics := g.promMetrics.render() + g.cache.render() + g.renderBreakerStates()
 
 	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
 	rw.WriteHeader(http.StatusOK)
@@ -1087,6 +1442,18 @@ func (pm *prometheusMetrics) render() string {
 		}
 	}
 
+	buf.WriteString("# HELP traefik_geoblock_lookups_total GeoIP lookups by the provider that answered (\"none\" when no provider did)\n")
+	buf.WriteString("# TYPE traefik_geoblock_lookups_total counter\n")
+	for provider, count := range pm.lookups {
+		buf.WriteString(fmt.Sprintf("traefik_geoblock_lookups_total{provider=\"%s\"} %d\n", escapePrometheusLabel(provider), count))
+	}
+
+	buf.WriteString("# HELP traefik_geoblock_spoof_attempts_total Forwarding headers ignored because the peer is not a trusted proxy\n")
+	buf.WriteString("# TYPE traefik_geoblock_spoof_attempts_total counter\n")
+	for header, count := range pm.spoofAttempts {
+		buf.WriteString(fmt.Sprintf("traefik_geoblock_spoof_attempts_total{header=\"%s\"} %d\n", escapePrometheusLabel(header), count))
+	}
+
 	return buf.String()
 }
 
@@ -2,9 +2,14 @@ package traefik_geoblock_plugin
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCreateConfig(t *testing.T) {
@@ -42,18 +47,6 @@ func TestNew(t *testing.T) {
 }
 
 func TestPrivateIPDetection(t *testing.T) {
-	config := CreateConfig()
-	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		rw.WriteHeader(http.StatusOK)
-	})
-
-	handler, err := New(context.Background(), next, config, "test-geoblock")
-	if err != nil {
-		t.Fatalf("Failed to create plugin: %v", err)
-	}
-
-	geoBlock := handler.(*GeoBlock)
-
 	testCases := []struct {
 		ip       string
 		expected bool
@@ -67,9 +60,9 @@ func TestPrivateIPDetection(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		result := geoBlock.isPrivateIP(tc.ip)
+		result := lookupSpecialRange(net.ParseIP(tc.ip)) != nil
 		if result != tc.expected {
-			t.Errorf("isPrivateIP(%s) = %v, expected %v", tc.ip, result, tc.expected)
+			t.Errorf("lookupSpecialRange(%s) found = %v, expected %v", tc.ip, result, tc.expected)
 		}
 	}
 }
@@ -224,12 +217,12 @@ func TestShouldBlock(t *testing.T) {
 }
 
 func TestCache(t *testing.T) {
-	cache := &geoCache{entries: make(map[string]*cacheEntry)}
+	cache := newGeoCache(100)
 
 	// Test setting and getting
 	testInfo := &geoInfo{Country: "US", Organization: "Test Org"}
 	cache.set("1.2.3.4", testInfo, 60*1000)
-	info := cache.get("1.2.3.4")
+	info := cachedInfo(cache, "1.2.3.4")
 
 	if info == nil {
 		t.Fatal("Expected geoInfo, got nil")
@@ -244,7 +237,7 @@ func TestCache(t *testing.T) {
 	}
 
 	// Test non-existent entry
-	info = cache.get("5.6.7.8")
+	info = cachedInfo(cache, "5.6.7.8")
 	if info != nil {
 		t.Errorf("Expected nil for non-existent entry, got '%v'", info)
 	}
@@ -283,3 +276,228 @@ func TestServeHTTP(t *testing.T) {
 		t.Errorf("Expected status 200, got %d", rw.Code)
 	}
 }
+
+func newOrganizationTestGeoBlock(t *testing.T, source string) (*GeoBlock, *int32) {
+	t.Helper()
+
+	apiHits := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(apiHits, 1)
+		_, _ = rw.Write([]byte(`{"country_code":"AU","org":"From API"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	builder := &rangeIndexBuilder{}
+	builder.add(net.ParseIP("1.1.1.0"), net.ParseIP("1.1.1.255"), geoRecord{country: "AU", asn: 13335, asName: "Cloudflare, Inc."})
+	builder.add(net.ParseIP("1.0.0.0"), net.ParseIP("1.0.0.255"), geoRecord{country: "AU"})
+
+	config := CreateConfig()
+	config.QueryURL = server.URL + "/{ip}"
+	config.OrganizationSource = source
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	geoBlock := handler.(*GeoBlock)
+	geoBlock.localDB = &localDatabase{active: &databaseSnapshot{index: builder.build()}}
+
+	return geoBlock, apiHits
+}
+
+func TestGetGeoInfoOrganizationSource(t *testing.T) {
+	testCases := []struct {
+		source       string
+		ip           string
+		organization string
+	}{
+		{OrganizationSourceLocalDB, "1.1.1.1", "Cloudflare, Inc."},
+		{OrganizationSourceLocalDB, "1.0.0.1", ""},
+		{OrganizationSourceNone, "1.1.1.1", ""},
+		{OrganizationSourceAPIAsync, "1.1.1.1", "Cloudflare, Inc."},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source+"/"+tc.ip, func(t *testing.T) {
+			geoBlock, apiHits := newOrganizationTestGeoBlock(t, tc.source)
+
+			info, err := geoBlock.getGeoInfo(tc.ip)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if info.Country != "AU" || info.Organization != tc.organization {
+				t.Errorf("Expected AU/%q, got %+v", tc.organization, info)
+			}
+			if hits := atomic.LoadInt32(apiHits); hits != 0 {
+				t.Errorf("Expected no API calls, got %d", hits)
+			}
+		})
+	}
+}
+
+func TestGetGeoInfoOrganizationAPIAsync(t *testing.T) {
+	geoBlock, apiHits := newOrganizationTestGeoBlock(t, OrganizationSourceAPIAsync)
+
+	// The decision is made from the local database without waiting for the API
+	info, err := geoBlock.getGeoInfo("1.0.0.1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Country != "AU" || info.Organization != "" {
+		t.Errorf("Expected AU without organization, got %+v", info)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cached := cachedInfo(geoBlock.cache, "1.0.0.1"); cached != nil && cached.Organization == "From API" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if cached := cachedInfo(geoBlock.cache, "1.0.0.1"); cached == nil || cached.Organization != "From API" {
+		t.Errorf("Expected cache entry to be enriched from API, got %+v", cached)
+	}
+	if hits := atomic.LoadInt32(apiHits); hits != 1 {
+		t.Errorf("Expected 1 API call, got %d", hits)
+	}
+}
+
+func TestGetGeoInfoOrganizationAPIAsyncNetworkCache(t *testing.T) {
+	geoBlock, _ := newOrganizationTestGeoBlock(t, OrganizationSourceAPIAsync)
+	geoBlock.cache.setPrefixLengths(32, 0)
+
+	builder := &rangeIndexBuilder{}
+	builder.add(net.ParseIP("1.0.0.0"), net.ParseIP("1.255.255.255"), geoRecord{country: "AU"})
+	geoBlock.localDB = &localDatabase{active: &databaseSnapshot{index: builder.build()}}
+
+	if _, err := geoBlock.getGeoInfo("1.2.3.4"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	enriched := func() bool {
+		hit, ok := geoBlock.cache.getAddress(net.ParseIP("1.2.3.4"))
+		return ok && hit.info.Organization == "From API"
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !enriched() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !enriched() {
+		t.Fatal("Expected the cache entry of 1.2.3.4 to be enriched from API")
+	}
+
+	// The organization of 1.2.3.4 must not spread to the rest of the range
+	info, err := geoBlock.getGeoInfo("1.200.0.9")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Country != "AU" || info.Organization != "" {
+		t.Errorf("Expected AU without organization for a sibling address, got %+v", info)
+	}
+}
+
+func TestNewRejectsInvalidOrganizationSource(t *testing.T) {
+	config := CreateConfig()
+	config.OrganizationSource = "sometimes"
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Error("Expected error for invalid organizationSource")
+	}
+}
+
+func TestNewRejectsInvalidRefreshInterval(t *testing.T) {
+	for _, interval := range []string{"daily", "0s", "-1h"} {
+		config := CreateConfig()
+		config.DatabaseRefreshInterval = interval
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+			t.Errorf("Expected error for databaseRefreshInterval %q", interval)
+		}
+	}
+}
+
+func TestNewRejectsInvalidCacheOptions(t *testing.T) {
+	invalid := map[string]func(config *Config){
+		"negative IPv4":     func(config *Config) { config.CacheIPv4Prefix = -1 },
+		"long IPv4":         func(config *Config) { config.CacheIPv4Prefix = 33 },
+		"long IPv6":         func(config *Config) { config.CacheIPv6Prefix = 129 },
+		"negative duration": func(config *Config) { config.CacheNegativeDuration = "soon" },
+		"stale duration":    func(config *Config) { config.CacheStaleDuration = "-1m" },
+		"persist interval":  func(config *Config) { config.CachePersistInterval = "0s" },
+	}
+	for name, configure := range invalid {
+		config := CreateConfig()
+		configure(config)
+		if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// Without a download there is no file to default to
+	config := CreateConfig()
+	config.DatabaseFormat = DatabaseFormatMMDB
+	if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Error("Expected error for databaseFormat without databasePath")
+	}
+}
+
+func TestOfflineMode(t *testing.T) {
+	var apiHits int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&apiHits, 1)
+		_, _ = rw.Write([]byte(`{"country_code":"US"}`))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "dbip.csv")
+	if err := os.WriteFile(path, []byte("1.0.0.0,1.0.0.255,AU\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := CreateConfig()
+	config.QueryURL = server.URL + "/{ip}"
+	config.DatabasePath = path
+	config.OfflineMode = true
+
+	handler, err := New(ctx, http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	geoBlock := handler.(*GeoBlock)
+
+	if info, err := geoBlock.getGeoInfo("1.0.0.1"); err != nil || info.Country != "AU" {
+		t.Errorf("Expected AU from the mounted database, got %+v (%v)", info, err)
+	}
+	if info, err := geoBlock.getGeoInfo("8.8.8.8"); err != nil || info.Country != CountryUnknown {
+		t.Errorf("Expected %s for an address missing from the database, got %+v (%v)", CountryUnknown, info, err)
+	}
+	if hits := atomic.LoadInt32(&apiHits); hits != 0 {
+		t.Errorf("Expected no API calls in offline mode, got %d", hits)
+	}
+}
+
+func TestNewRejectsInvalidOfflineMode(t *testing.T) {
+	testCases := map[string]func(config *Config){
+		"no database":  func(config *Config) {},
+		"mmdb format":  func(config *Config) { config.DatabaseFormat = DatabaseFormatMMDB },
+		"download URL": func(config *Config) { config.DatabaseURL = "https://example.com/db.csv" },
+		"api-async": func(config *Config) {
+			config.DatabasePath = "/tmp/db.csv"
+			config.OrganizationSource = OrganizationSourceAPIAsync
+		},
+	}
+
+	for name, configure := range testCases {
+		config := CreateConfig()
+		config.OfflineMode = true
+		configure(config)
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
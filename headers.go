@@ -0,0 +1,113 @@
+package traefik_geoblock_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Request headers added for downstream services
+
+const (
+	// defaultCountryHeader carries the country code of allowed requests
+	defaultCountryHeader = "X-Country-Code"
+	// defaultOrganizationHeader carries the organization of allowed requests
+	defaultOrganizationHeader = "X-Organization"
+)
+
+// Values of the decision header
+const (
+	// DecisionAllowed means the country passed allowedCountries and blockedCountries
+	DecisionAllowed = "allowed"
+	// DecisionDefault means no country was determined and the request was let through
+	DecisionDefault = "default"
+)
+
+// DownstreamHeaders names the headers set on forwarded requests. Each configured
+// header, and X-Country-Code and X-Organization under any names, is removed from
+// the inbound request first, so backends never see a value supplied by the
+// client. Optional headers are only set when named.
+type DownstreamHeaders struct {
+	Country      string `json:"country,omitempty"`      // Country code (default: "X-Country-Code")
+	Organization string `json:"organization,omitempty"` // Organization, when known (default: "X-Organization")
+	ASN          string `json:"asn,omitempty"`          // Autonomous system number, when known
+	Continent    string `json:"continent,omitempty"`    // Continent code, when known
+	Source       string `json:"source,omitempty"`       // Name of the provider that answered
+	Decision     string `json:"decision,omitempty"`     // "allowed" or "default"
+}
+
+// resolve fills in the default names and checks that every name is a valid
+// and distinct header name
+func (h DownstreamHeaders) resolve() (DownstreamHeaders, error) {
+	if h.Country == "" {
+		h.Country = defaultCountryHeader
+	}
+	if h.Organization == "" {
+		h.Organization = defaultOrganizationHeader
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range []*string{&h.Country, &h.Organization, &h.ASN, &h.Continent, &h.Source, &h.Decision} {
+		if *name == "" {
+			continue
+		}
+		if !validHeaderName(*name) {
+			return h, fmt.Errorf("invalid header name %q", *name)
+		}
+		*name = http.CanonicalHeaderKey(*name)
+		if seen[*name] {
+			return h, fmt.Errorf("header %s is configured more than once", *name)
+		}
+		seen[*name] = true
+	}
+	return h, nil
+}
+
+// strip removes the configured and default headers from the inbound request
+func (h DownstreamHeaders) strip(req *http.Request) {
+	req.Header.Del(defaultCountryHeader)
+	req.Header.Del(defaultOrganizationHeader)
+	for _, name := range []string{h.Country, h.Organization, h.ASN, h.Continent, h.Source, h.Decision} {
+		if name != "" {
+			req.Header.Del(name)
+		}
+	}
+}
+
+// set adds the headers for a request let through with decision; info is nil
+// when no country was determined
+func (h DownstreamHeaders) set(req *http.Request, info *geoInfo, decision string) {
+	if h.Decision != "" {
+		req.Header.Set(h.Decision, decision)
+	}
+	if info == nil {
+		return
+	}
+
+	req.Header.Set(h.Country, info.Country)
+	setIfPresent := func(name, value string) {
+		if name != "" && value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	setIfPresent(h.Organization, info.Organization)
+	setIfPresent(h.Continent, info.Continent)
+	setIfPresent(h.Source, info.Source)
+	if info.ASN != 0 {
+		setIfPresent(h.ASN, strconv.FormatUint(uint64(info.ASN), 10))
+	}
+}
+
+// validHeaderName reports whether name is an RFC 7230 token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
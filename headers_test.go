@@ -0,0 +1,97 @@
+package traefik_geoblock_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDownstreamHeaders(t *testing.T) {
+	url, _ := newProviderAPI(t, http.StatusOK, `{"country_code":"SE","org":"Example AB","asn":"AS64500","continent_code":"EU"}`, 0)
+
+	testCases := []struct {
+		name     string
+		headers  DownstreamHeaders
+		queryURL string
+		expected map[string]string
+	}{
+		{
+			name:     "default headers",
+			headers:  CreateConfig().Headers,
+			queryURL: url,
+			expected: map[string]string{"X-Country-Code": "SE", "X-Organization": "Example AB", "X-Asn": "spoofed", "X-Geoblock-Decision": "spoofed"},
+		},
+		{
+			name:     "renamed and optional headers",
+			headers:  DownstreamHeaders{Country: "x-geo-country", ASN: "X-Geo-ASN", Continent: "X-Geo-Continent", Source: "X-Geo-Source", Decision: "X-Geoblock-Decision"},
+			queryURL: url,
+			expected: map[string]string{
+				"X-Geo-Country":       "SE",
+				"X-Organization":      "Example AB",
+				"X-Geo-Asn":           "64500",
+				"X-Geo-Continent":     "EU",
+				"X-Geo-Source":        "ipapi",
+				"X-Geoblock-Decision": DecisionAllowed,
+				"X-Country-Code":      "",
+			},
+		},
+		{
+			name:     "failed lookup strips client values",
+			headers:  DownstreamHeaders{ASN: "X-Asn", Decision: "X-Geoblock-Decision"},
+			queryURL: "http://127.0.0.1:1/{ip}",
+			expected: map[string]string{"X-Country-Code": "", "X-Organization": "", "X-Asn": "", "X-Geoblock-Decision": DecisionDefault},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var forwarded http.Header
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req.Header
+			})
+
+			config := CreateConfig()
+			config.Headers = tc.headers
+			config.Providers = []ProviderConfig{{Name: "ipapi", Type: ProviderHTTPJSON, URL: tc.queryURL}}
+			config.LogBlocked = false
+
+			handler, err := New(context.Background(), next, config, "test")
+			if err != nil {
+				t.Fatalf("Failed to create plugin: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			req.RemoteAddr = "8.8.8.8:1234"
+			for _, name := range []string{"X-Country-Code", "X-Organization", "X-Asn", "X-Geoblock-Decision"} {
+				req.Header.Set(name, "spoofed")
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if forwarded == nil {
+				t.Fatal("Expected the request to be forwarded")
+			}
+			for name, want := range tc.expected {
+				if got := forwarded.Get(name); got != want {
+					t.Errorf("Expected %s %q, got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidHeaders(t *testing.T) {
+	for _, headers := range []DownstreamHeaders{
+		{Country: "X Country"},
+		{ASN: "X-ASN:"},
+		{Source: "x-country-code"},
+		{Continent: "X-Geo", Decision: "X-Geo"},
+	} {
+		config := CreateConfig()
+		config.Headers = headers
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+			t.Errorf("Expected error for headers %+v", headers)
+		}
+	}
+}
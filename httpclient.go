@@ -0,0 +1,102 @@
+package traefik_geoblock_plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Outbound HTTP client shared by the providers and database downloads of a middleware
+
+const (
+	// defaultHTTPTimeout bounds provider calls that do not configure their own timeout
+	defaultHTTPTimeout = 5 * time.Second
+	// defaultHTTPMaxIdleConns is the number of kept-alive connections per host
+	defaultHTTPMaxIdleConns = 10
+	// databaseDownloadTimeout bounds a complete database download
+	databaseDownloadTimeout = 5 * time.Minute
+)
+
+// newHTTPTransport builds the transport from the http* options. Proxies from the
+// environment (HTTPS_PROXY, ...) are used unless httpProxyURL is set.
+func newHTTPTransport(config *Config) (*http.Transport, error) {
+	maxIdleConns := config.HTTPMaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultHTTPMaxIdleConns
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	if config.HTTPProxyURL != "" {
+		proxyURL, err := url.Parse(config.HTTPProxyURL)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid httpProxyURL %q", redactURL(config.HTTPProxyURL))
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.HTTPCABundle != "" || config.HTTPTLSServerName != "" {
+		tlsConfig := &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: config.HTTPTLSServerName,
+		}
+
+		if config.HTTPCABundle != "" {
+			pem, err := os.ReadFile(config.HTTPCABundle)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read httpCABundle: %w", err)
+			}
+			// Trust the bundle in addition to the system roots
+			pool, err := x509.SystemCertPool()
+			if err != nil || pool == nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in httpCABundle %s", config.HTTPCABundle)
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+// newHTTPClients returns the client used for provider calls and the one used
+// for database downloads; both share one transport and its connection pool
+func newHTTPClients(config *Config) (*http.Client, *http.Client, error) {
+	timeout := defaultHTTPTimeout
+	if config.HTTPTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(config.HTTPTimeout); err != nil || timeout <= 0 {
+			return nil, nil, fmt.Errorf("invalid httpTimeout %q", config.HTTPTimeout)
+		}
+	}
+
+	transport, err := newHTTPTransport(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout},
+		&http.Client{Transport: transport, Timeout: databaseDownloadTimeout},
+		nil
+}
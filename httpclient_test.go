@@ -0,0 +1,110 @@
+package traefik_geoblock_plugin
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTPClientCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(`{"country_code":"SE"}`))
+	}))
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certificate, 0o600); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+
+	newGeoBlock := func(caBundle, serverName string) *GeoBlock {
+		config := CreateConfig()
+		config.QueryURL = server.URL + "/{ip}"
+		config.HTTPCABundle = caBundle
+		config.HTTPTLSServerName = serverName
+
+		handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+		if err != nil {
+			t.Fatalf("Failed to create plugin: %v", err)
+		}
+		return handler.(*GeoBlock)
+	}
+
+	if _, err := newGeoBlock("", "").getGeoInfo("1.1.1.1"); err == nil {
+		t.Error("Expected the private CA to be rejected without httpCABundle")
+	}
+	if info, err := newGeoBlock(bundle, "").getGeoInfo("1.1.1.1"); err != nil || info.Country != "SE" {
+		t.Errorf("Expected SE through the trusted CA, got %+v (%v)", info, err)
+	}
+	// The test certificate is issued for example.com
+	if info, err := newGeoBlock(bundle, "example.com").getGeoInfo("1.1.1.1"); err != nil || info.Country != "SE" {
+		t.Errorf("Expected SE with httpTLSServerName, got %+v (%v)", info, err)
+	}
+	if _, err := newGeoBlock(bundle, "geoip.internal").getGeoInfo("1.1.1.1"); err == nil {
+		t.Error("Expected a server name mismatch to be rejected")
+	}
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		proxied <- req.URL.Host
+		_, _ = rw.Write([]byte(`{"country_code":"NO"}`))
+	}))
+	defer proxy.Close()
+
+	config := CreateConfig()
+	config.QueryURL = "http://geoip.invalid/{ip}"
+	config.HTTPProxyURL = proxy.URL
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+
+	if info, err := handler.(*GeoBlock).getGeoInfo("1.1.1.1"); err != nil || info.Country != "NO" {
+		t.Errorf("Expected NO through the proxy, got %+v (%v)", info, err)
+	}
+	if host := <-proxied; host != "geoip.invalid" {
+		t.Errorf("Expected the proxy to receive the request for geoip.invalid, got %q", host)
+	}
+}
+
+func TestNewHTTPClients(t *testing.T) {
+	config := CreateConfig()
+	config.HTTPTimeout = "2s"
+	config.HTTPMaxIdleConns = 32
+
+	client, downloadClient, err := newHTTPClients(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if client.Timeout != 2*time.Second || downloadClient.Timeout != databaseDownloadTimeout {
+		t.Errorf("Unexpected timeouts %v and %v", client.Timeout, downloadClient.Timeout)
+	}
+	if client.Transport != downloadClient.Transport {
+		t.Error("Expected the clients to share one transport")
+	}
+	if transport := client.Transport.(*http.Transport); transport.MaxIdleConnsPerHost != 32 {
+		t.Errorf("Expected 32 idle connections per host, got %d", transport.MaxIdleConnsPerHost)
+	}
+
+	invalid := map[string]func(config *Config){
+		"timeout":   func(config *Config) { config.HTTPTimeout = "fast" },
+		"proxy":     func(config *Config) { config.HTTPProxyURL = "proxy:3128" },
+		"CA bundle": func(config *Config) { config.HTTPCABundle = filepath.Join(t.TempDir(), "missing.pem") },
+	}
+	for name, configure := range invalid {
+		config := CreateConfig()
+		configure(config)
+		if _, _, err := newHTTPClients(config); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package traefik_geoblock_plugin
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+)
+
+// rangeIndex is an immutable, sorted and non-overlapping view of a range database.
+// IPv4 and IPv6 ranges are kept in separate tables keyed by fixed-width integers,
+// so a lookup is a single binary search without any allocation. Ranges refer to
+// deduplicated records, which keeps millions of rows down to a few bytes each.
+type rangeIndex struct {
+	v4      []v4Range
+	v6      []v6Range
+	records []geoRecord
+}
+
+// geoRecord is the data stored for a range
+type geoRecord struct {
+	country   string
+	continent string
+	asn       uint32
+	asName    string
+	asDomain  string
+}
+
+type v4Range struct {
+	start  uint32
+	end    uint32
+	record uint32
+}
+
+type v6Range struct {
+	start  uint128
+	end    uint128
+	record uint32
+}
+
+// uint128 is a big-endian 128-bit integer used as the IPv6 table key
+type uint128 struct {
+	hi uint64
+	lo uint64
+}
+
+// rangeIndexBuilder collects ranges in any order and produces a rangeIndex
+type rangeIndexBuilder struct {
+	v4        []v4Range
+	v6        []v6Range
+	records   []geoRecord
+	recordIDs map[geoRecord]uint32
+}
+
+func (a uint128) less(b uint128) bool {
+	return a.hi < b.hi || (a.hi == b.hi && a.lo < b.lo)
+}
+
+func (a uint128) next() uint128 {
+	if a.lo == ^uint64(0) {
+		return uint128{hi: a.hi + 1}
+	}
+	return uint128{hi: a.hi, lo: a.lo + 1}
+}
+
+func (a uint128) isMax() bool {
+	return a.hi == ^uint64(0) && a.lo == ^uint64(0)
+}
+
+// prefix returns the first and last address of the /ones network containing a
+func (a uint128) prefix(ones int) (uint128, uint128) {
+	if ones <= 64 {
+		mask := ^uint64(0) << uint(64-ones)
+		return uint128{hi: a.hi & mask}, uint128{hi: a.hi | ^mask, lo: ^uint64(0)}
+	}
+	mask := ^uint64(0) << uint(128-ones)
+	return uint128{hi: a.hi, lo: a.lo & mask}, uint128{hi: a.hi, lo: a.lo | ^mask}
+}
+
+func ipv6Key(ip net.IP) uint128 {
+	return uint128{
+		hi: binary.BigEndian.Uint64(ip[:8]),
+		lo: binary.BigEndian.Uint64(ip[8:16]),
+	}
+}
+
+// add registers the inclusive range [start, end]. Ranges whose endpoints are of
+// different address families or are reversed are ignored and add returns false.
+func (b *rangeIndexBuilder) add(start, end net.IP, record geoRecord) bool {
+	if start4, end4 := start.To4(), end.To4(); start4 != nil || end4 != nil {
+		if start4 == nil || end4 == nil {
+			return false
+		}
+		s, e := binary.BigEndian.Uint32(start4), binary.BigEndian.Uint32(end4)
+		if s > e {
+			return false
+		}
+		b.v4 = append(b.v4, v4Range{start: s, end: e, record: b.intern(record)})
+		return true
+	}
+
+	start16, end16 := start.To16(), end.To16()
+	if start16 == nil || end16 == nil {
+		return false
+	}
+	s, e := ipv6Key(start16), ipv6Key(end16)
+	if e.less(s) {
+		return false
+	}
+	b.v6 = append(b.v6, v6Range{start: s, end: e, record: b.intern(record)})
+	return true
+}
+
+// intern returns the id of record, storing it on first use
+func (b *rangeIndexBuilder) intern(record geoRecord) uint32 {
+	if b.recordIDs == nil {
+		b.recordIDs = make(map[geoRecord]uint32)
+	}
+	if id, ok := b.recordIDs[record]; ok {
+		return id
+	}
+	id := uint32(len(b.records))
+	b.records = append(b.records, record)
+	b.recordIDs[record] = id
+	return id
+}
+
+// build sorts the collected ranges, clips overlaps (the range starting first wins)
+// and merges adjacent ranges carrying the same data. The builder must not be
+// reused afterwards.
+func (b *rangeIndexBuilder) build() *rangeIndex {
+	return &rangeIndex{
+		v4:      normalizeV4Ranges(b.v4),
+		v6:      normalizeV6Ranges(b.v6),
+		records: b.records,
+	}
+}
+
+func normalizeV4Ranges(ranges []v4Range) []v4Range {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	out := ranges[:0]
+	for _, r := range ranges {
+		if len(out) > 0 {
+			last := &out[len(out)-1]
+			if r.start <= last.end {
+				if r.end <= last.end || last.end == ^uint32(0) {
+					continue
+				}
+				r.start = last.end + 1
+			}
+			if r.record == last.record && r.start == last.end+1 {
+				last.end = r.end
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func normalizeV6Ranges(ranges []v6Range) []v6Range {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start.less(ranges[j].start)
+	})
+
+	out := ranges[:0]
+	for _, r := range ranges {
+		if len(out) > 0 {
+			last := &out[len(out)-1]
+			if !last.end.less(r.start) {
+				if !last.end.less(r.end) || last.end.isMax() {
+					continue
+				}
+				r.start = last.end.next()
+			}
+			if r.record == last.record && r.start == last.end.next() {
+				last.end = r.end
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// lookup returns the record of the range containing ip
+func (idx *rangeIndex) lookup(ip net.IP) (geoRecord, bool) {
+	if idx == nil {
+		return geoRecord{}, false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if r := idx.findV4(binary.BigEndian.Uint32(ip4)); r != nil {
+			return idx.records[r.record], true
+		}
+		return geoRecord{}, false
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return geoRecord{}, false
+	}
+	if r := idx.findV6(ipv6Key(ip16)); r != nil {
+		return idx.records[r.record], true
+	}
+	return geoRecord{}, false
+}
+
+// lookupNetwork is lookup that also returns the largest network around ip
+// lying entirely within the matched range, i.e. sharing the same answer
+func (idx *rangeIndex) lookupNetwork(ip net.IP) (geoRecord, *net.IPNet, bool) {
+	if idx == nil {
+		return geoRecord{}, nil, false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		key := binary.BigEndian.Uint32(ip4)
+		r := idx.findV4(key)
+		if r == nil {
+			return geoRecord{}, nil, false
+		}
+		ones := 32
+		for ones > 0 {
+			mask := ^uint32(0) << uint(33-ones)
+			if first, last := key&mask, key|^mask; first < r.start || last > r.end {
+				break
+			}
+			ones--
+		}
+		network := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(network, key&(^uint32(0)<<uint(32-ones)))
+		return idx.records[r.record], &net.IPNet{IP: network, Mask: net.CIDRMask(ones, 32)}, true
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return geoRecord{}, nil, false
+	}
+	key := ipv6Key(ip16)
+	r := idx.findV6(key)
+	if r == nil {
+		return geoRecord{}, nil, false
+	}
+	ones := 128
+	for ones > 0 {
+		if first, last := key.prefix(ones - 1); first.less(r.start) || r.end.less(last) {
+			break
+		}
+		ones--
+	}
+	first, _ := key.prefix(ones)
+	network := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(network[:8], first.hi)
+	binary.BigEndian.PutUint64(network[8:], first.lo)
+	return idx.records[r.record], &net.IPNet{IP: network, Mask: net.CIDRMask(ones, 128)}, true
+}
+
+func (idx *rangeIndex) findV4(key uint32) *v4Range {
+	i := sort.Search(len(idx.v4), func(i int) bool {
+		return idx.v4[i].end >= key
+	})
+	if i < len(idx.v4) && idx.v4[i].start <= key {
+		return &idx.v4[i]
+	}
+	return nil
+}
+
+func (idx *rangeIndex) findV6(key uint128) *v6Range {
+	i := sort.Search(len(idx.v6), func(i int) bool {
+		return !idx.v6[i].end.less(key)
+	})
+	if i < len(idx.v6) && !key.less(idx.v6[i].start) {
+		return &idx.v6[i]
+	}
+	return nil
+}
+
+// size returns the number of ranges held by the index
+func (idx *rangeIndex) size() int {
+	if idx == nil {
+		return 0
+	}
+	return len(idx.v4) + len(idx.v6)
+}
@@ -0,0 +1,214 @@
+package traefik_geoblock_plugin
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRangeIndexLookup(t *testing.T) {
+	builder := &rangeIndexBuilder{}
+	// Added out of order on purpose, including an overlap and an IPv6 range
+	builder.add(net.ParseIP("8.8.8.0"), net.ParseIP("8.8.8.255"), geoRecord{country: "US"})
+	builder.add(net.ParseIP("1.0.0.0"), net.ParseIP("1.0.0.255"), geoRecord{country: "AU"})
+	builder.add(net.ParseIP("1.0.0.128"), net.ParseIP("1.0.1.255"), geoRecord{country: "CN"})
+	builder.add(net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ffff"), geoRecord{country: "DE"})
+	builder.add(net.ParseIP("255.255.255.0"), net.ParseIP("255.255.255.255"), geoRecord{country: "ZZ"})
+
+	if builder.add(net.ParseIP("1.2.3.4"), net.ParseIP("::1"), geoRecord{country: "XX"}) {
+		t.Error("Expected mixed-family range to be rejected")
+	}
+	if builder.add(net.ParseIP("1.2.3.4"), net.ParseIP("1.2.3.0"), geoRecord{country: "XX"}) {
+		t.Error("Expected reversed range to be rejected")
+	}
+
+	index := builder.build()
+
+	if index.size() != 5 {
+		t.Errorf("Expected 5 ranges, got %d", index.size())
+	}
+
+	testCases := []struct {
+		ip       string
+		expected string
+		found    bool
+	}{
+		{"1.0.0.0", "AU", true},
+		{"1.0.0.200", "AU", true},
+		{"1.0.1.0", "CN", true},
+		{"1.0.1.255", "CN", true},
+		{"1.0.2.0", "", false},
+		{"8.8.8.8", "US", true},
+		{"8.8.9.1", "", false},
+		{"255.255.255.255", "ZZ", true},
+		{"::ffff:8.8.8.8", "US", true},
+		{"2001:db8::1", "DE", true},
+		{"2001:db8::1:0", "", false},
+		{"::1", "", false},
+	}
+
+	for _, tc := range testCases {
+		record, found := index.lookup(net.ParseIP(tc.ip))
+		if found != tc.found || record.country != tc.expected {
+			t.Errorf("lookup(%s) = (%q, %v), expected (%q, %v)", tc.ip, record.country, found, tc.expected, tc.found)
+		}
+	}
+}
+
+func TestRangeIndexMergesAdjacentRanges(t *testing.T) {
+	builder := &rangeIndexBuilder{}
+	builder.add(net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.255"), geoRecord{country: "IT"})
+	builder.add(net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.255"), geoRecord{country: "IT"})
+	builder.add(net.ParseIP("10.0.2.0"), net.ParseIP("10.0.2.255"), geoRecord{country: "FR"})
+
+	index := builder.build()
+
+	if index.size() != 2 {
+		t.Fatalf("Expected 2 ranges after merge, got %d", index.size())
+	}
+
+	if record, _ := index.lookup(net.ParseIP("10.0.1.10")); record.country != "IT" {
+		t.Errorf("Expected IT, got %q", record.country)
+	}
+}
+
+func TestRangeIndexLookupNetwork(t *testing.T) {
+	builder := &rangeIndexBuilder{}
+	builder.add(net.ParseIP("10.0.0.0"), net.ParseIP("10.0.1.255"), geoRecord{country: "IT"})
+	builder.add(net.ParseIP("10.0.2.0"), net.ParseIP("10.0.2.130"), geoRecord{country: "FR"})
+	builder.add(net.ParseIP("0.0.0.0"), net.ParseIP("0.0.0.0"), geoRecord{country: "ZZ"})
+	builder.add(net.ParseIP("2001:db8::"), net.ParseIP("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"), geoRecord{country: "DE"})
+	builder.add(net.ParseIP("2001:db9::"), net.ParseIP("2001:db9::4"), geoRecord{country: "NL"})
+	index := builder.build()
+
+	testCases := []struct {
+		ip      string
+		network string
+	}{
+		{"10.0.0.5", "10.0.0.0/23"},
+		{"10.0.2.5", "10.0.2.0/25"},
+		{"10.0.2.129", "10.0.2.128/31"},
+		{"10.0.2.130", "10.0.2.130/32"},
+		{"0.0.0.0", "0.0.0.0/32"},
+		{"::ffff:10.0.1.1", "10.0.0.0/23"},
+		{"2001:db8:1::1", "2001:db8::/32"},
+		{"2001:db9::3", "2001:db9::/126"},
+		{"2001:db9::4", "2001:db9::4/128"},
+	}
+
+	for _, tc := range testCases {
+		_, network, found := index.lookupNetwork(net.ParseIP(tc.ip))
+		if !found || network.String() != tc.network {
+			t.Errorf("lookupNetwork(%s) = %v, expected %s", tc.ip, network, tc.network)
+		}
+	}
+
+	if _, network, found := index.lookupNetwork(net.ParseIP("10.0.3.1")); found || network != nil {
+		t.Errorf("Expected no match, got %v", network)
+	}
+}
+
+func TestLookupLocalDatabase(t *testing.T) {
+	g := &GeoBlock{localDB: &localDatabase{active: &databaseSnapshot{index: buildTestIndex(t, parseIPInfoJSON, `[
+		{"start_ip": "5.6.7.0", "end_ip": "5.6.7.255", "country": "de"},
+		{"start_ip": "invalid", "end_ip": "5.6.8.255", "country": "FR"}
+	]`)}}}
+
+	if info := g.lookupLocalDatabase("5.6.7.8"); info == nil || info.Country != "DE" {
+		t.Errorf("Expected DE, got %v", info)
+	}
+
+	if info := g.lookupLocalDatabase("5.6.8.1"); info != nil {
+		t.Errorf("Expected no match, got %v", info)
+	}
+
+	if info := g.lookupLocalDatabase("not-an-ip"); info != nil {
+		t.Errorf("Expected no match, got %v", info)
+	}
+}
+
+func buildTestIndex(t *testing.T, parse rangeParser, data string) *rangeIndex {
+	t.Helper()
+
+	builder := &rangeIndexBuilder{}
+	if _, err := parse(strings.NewReader(data), builder); err != nil {
+		t.Fatalf("Failed to parse database: %v", err)
+	}
+	return builder.build()
+}
+
+// newSyntheticIndex builds an index of n contiguous IPv4 ranges plus n/2 IPv6 ranges
+func newSyntheticIndex(n int) *rangeIndex {
+	countries := []string{"US", "DE", "IT", "FR", "CN", "BR", "JP", "GB"}
+	builder := &rangeIndexBuilder{}
+
+	step := uint32((1 << 32) / uint64(n))
+	for i := 0; i < n; i++ {
+		start := make(net.IP, 4)
+		end := make(net.IP, 4)
+		binary.BigEndian.PutUint32(start, uint32(i)*step)
+		binary.BigEndian.PutUint32(end, uint32(i)*step+step-1)
+		builder.add(start, end, geoRecord{country: countries[i%len(countries)]})
+	}
+
+	for i := 0; i < n/2; i++ {
+		start := make(net.IP, 16)
+		end := make(net.IP, 16)
+		binary.BigEndian.PutUint16(start, 0x2001)
+		binary.BigEndian.PutUint32(start[2:], uint32(i))
+		copy(end, start)
+		for j := 6; j < 16; j++ {
+			end[j] = 0xff
+		}
+		builder.add(start, end, geoRecord{country: countries[i%len(countries)]})
+	}
+
+	return builder.build()
+}
+
+func syntheticLookupIPs(n int) []net.IP {
+	ips := make([]net.IP, n)
+	for i := range ips {
+		if i%2 == 0 {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, uint32(i)*2654435761)
+			ips[i] = ip
+			continue
+		}
+		ip := make(net.IP, 16)
+		binary.BigEndian.PutUint16(ip, 0x2001)
+		binary.BigEndian.PutUint32(ip[2:], uint32(i*7919)%1000000)
+		ip[15] = byte(i)
+		ips[i] = ip
+	}
+	return ips
+}
+
+func BenchmarkRangeIndexLookup(b *testing.B) {
+	index := newSyntheticIndex(2000000)
+	ips := syntheticLookupIPs(1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := index.lookup(ips[i%len(ips)]); !ok {
+			b.Fatalf("lookup of %s missed", ips[i%len(ips)])
+		}
+	}
+}
+
+func BenchmarkLookupLocalDatabase(b *testing.B) {
+	g := &GeoBlock{localDB: &localDatabase{active: &databaseSnapshot{index: newSyntheticIndex(2000000)}}}
+	ips := syntheticLookupIPs(1024)
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if info := g.lookupLocalDatabase(addrs[i%len(addrs)]); info == nil {
+			b.Fatalf("lookup of %s missed", addrs[i%len(addrs)])
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package traefik_geoblock_plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MaxMind DB format support.
+//
+// This is a small, pure Go reader for the MaxMind DB format
+// (https://maxmind.github.io/MaxMind-DB/). It deliberately avoids cgo, unsafe
+// and memory mapping so it runs unchanged inside Yaegi: the whole file is read
+// into memory and decoded on demand.
+
+const (
+	mmdbTypeExtended = iota
+	mmdbTypePointer
+	mmdbTypeString
+	mmdbTypeDouble
+	mmdbTypeBytes
+	mmdbTypeUint16
+	mmdbTypeUint32
+	mmdbTypeMap
+	mmdbTypeInt32
+	mmdbTypeUint64
+	mmdbTypeUint128
+	mmdbTypeArray
+	mmdbTypeContainer
+	mmdbTypeEndMarker
+	mmdbTypeBool
+	mmdbTypeFloat
+)
+
+// mmdbDataSectionSeparator is the size of the zero-filled gap between the search tree and the data section
+const mmdbDataSectionSeparator = 16
+
+// mmdbMaxDepth bounds recursion when decoding nested maps/arrays from untrusted files
+const mmdbMaxDepth = 32
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+type mmdbReader struct {
+	buffer       []byte
+	data         []byte // data section
+	nodeCount    uint
+	recordSize   uint
+	nodeBytes    uint
+	ipVersion    uint
+	databaseType string
+	ipv4Start    uint
+}
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mmdb file: %w", err)
+	}
+	return newMMDBReader(buf)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	markerAt := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if markerAt < 0 {
+		return nil, errors.New("invalid mmdb file: metadata marker not found")
+	}
+
+	metaDecoder := &mmdbDecoder{buf: buf[markerAt+len(mmdbMetadataMarker):]}
+	value, _, err := metaDecoder.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mmdb metadata: %w", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid mmdb metadata: not a map")
+	}
+
+	r := &mmdbReader{
+		buffer:       buf,
+		nodeCount:    uint(mmdbUint(metadata["node_count"])),
+		recordSize:   uint(mmdbUint(metadata["record_size"])),
+		ipVersion:    uint(mmdbUint(metadata["ip_version"])),
+		databaseType: mmdbString(metadata["database_type"]),
+	}
+
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported mmdb record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported mmdb ip version %d", r.ipVersion)
+	}
+
+	r.nodeBytes = r.recordSize / 4
+	treeSize := r.nodeCount * r.nodeBytes
+	if treeSize+mmdbDataSectionSeparator > uint(markerAt) {
+		return nil, errors.New("invalid mmdb file: search tree exceeds file size")
+	}
+	r.data = buf[treeSize+mmdbDataSectionSeparator : markerAt]
+
+	// IPv4 addresses live under ::/96 in IPv6 trees; find that node once
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// lookup walks the search tree for ip and returns the decoded record, or nil if
+// the address is not in the database, along with the network the record covers.
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, *net.IPNet, error) {
+	node, bitCount := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bitCount = 32
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil, nil
+	} else {
+		ip = ip.To16()
+	}
+
+	depth := 0
+	for ; depth < bitCount && node < r.nodeCount; depth++ {
+		bit := (ip[depth>>3] >> (7 - uint(depth&7))) & 1
+		node = r.readNode(node, uint(bit))
+	}
+
+	if node == r.nodeCount {
+		return nil, nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, nil, errors.New("invalid mmdb search tree")
+	}
+
+	offset := node - r.nodeCount - mmdbDataSectionSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, nil, errors.New("invalid mmdb data pointer")
+	}
+
+	decoder := &mmdbDecoder{buf: r.data}
+	value, _, err := decoder.decode(offset, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	record, _ := value.(map[string]interface{})
+
+	mask := net.CIDRMask(depth, bitCount)
+	return record, &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+func (r *mmdbReader) readNode(node, bit uint) uint {
+	b := r.buffer[node*r.nodeBytes : (node+1)*r.nodeBytes]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// geoInfo extracts the fields used by the plugin from an mmdb record. Both the
+// MaxMind GeoIP2/GeoLite2 layout and the flat ipinfo layout are understood.
+func (r *mmdbReader) geoInfo(ip net.IP) (*geoInfo, error) {
+	record, network, err := r.lookup(ip)
+	if err != nil || record == nil {
+		return nil, err
+	}
+
+	info := &geoInfo{
+		Country:   mmdbString(mmdbPath(record, "country", "iso_code")),
+		Continent: mmdbString(mmdbPath(record, "continent", "code")),
+		ASN:       uint32(mmdbUint(record["autonomous_system_number"])),
+		network:   network,
+	}
+
+	if info.Country == "" {
+		info.Country = mmdbString(mmdbPath(record, "registered_country", "iso_code"))
+	}
+	if info.Country == "" {
+		info.Country = mmdbString(record["country_code"])
+	}
+	if info.Continent == "" {
+		info.Continent = mmdbString(record["continent_code"])
+	}
+	if info.ASN == 0 {
+		info.ASN = parseASN(mmdbString(record["asn"]))
+	}
+	info.ASDomain = mmdbString(record["as_domain"])
+
+	for _, key := range []string{"autonomous_system_organization", "as_name", "organization", "isp"} {
+		if org := mmdbString(record[key]); org != "" {
+			info.Organization = org
+			break
+		}
+	}
+
+	info.Country = strings.ToUpper(info.Country)
+	info.Continent = strings.ToUpper(info.Continent)
+	return info, nil
+}
+
+// decode decodes the value at offset and returns it along with the offset of the next value
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("mmdb data nested too deeply")
+	}
+
+	typeNum, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typeNum {
+	case mmdbTypePointer:
+		pointer, next, err := d.decodePointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	case mmdbTypeMap:
+		return d.decodeMap(size, offset, depth)
+	case mmdbTypeArray:
+		return d.decodeArray(size, offset, depth)
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	}
+
+	end := offset + size
+	if end < offset || end > uint(len(d.buf)) {
+		return nil, 0, errors.New("mmdb value exceeds data section")
+	}
+	value, err := decodeScalar(typeNum, d.buf[offset:end])
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, end, nil
+}
+
+// decodeMap decodes the size entries of a map starting at offset
+func (d *mmdbDecoder) decodeMap(size, offset uint, depth int) (interface{}, uint, error) {
+	m := make(map[string]interface{}, minUint(size, 64))
+	for i := uint(0); i < size; i++ {
+		var key, value interface{}
+		var err error
+		key, offset, err = d.decode(offset, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, offset, err = d.decode(offset, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, 0, errors.New("mmdb map key is not a string")
+		}
+		m[k] = value
+	}
+	return m, offset, nil
+}
+
+// decodeArray decodes the size elements of an array starting at offset
+func (d *mmdbDecoder) decodeArray(size, offset uint, depth int) (interface{}, uint, error) {
+	a := make([]interface{}, 0, minUint(size, 64))
+	for i := uint(0); i < size; i++ {
+		var value interface{}
+		var err error
+		value, offset, err = d.decode(offset, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		a = append(a, value)
+	}
+	return a, offset, nil
+}
+
+// decodeScalar decodes a fixed-size value of type typeNum from b
+func decodeScalar(typeNum int, b []byte) (interface{}, error) {
+	size := len(b)
+	switch typeNum {
+	case mmdbTypeString:
+		return string(b), nil
+	case mmdbTypeBytes:
+		return append([]byte(nil), b...), nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, fmt.Errorf("invalid mmdb double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, fmt.Errorf("invalid mmdb float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		if size > 8 {
+			return nil, fmt.Errorf("invalid mmdb integer size %d", size)
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, nil
+	case mmdbTypeInt32:
+		if size > 4 {
+			return nil, fmt.Errorf("invalid mmdb int32 size %d", size)
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int32(v), nil
+	case mmdbTypeUint128:
+		if size > 16 {
+			return nil, fmt.Errorf("invalid mmdb uint128 size %d", size)
+		}
+		return new(big.Int).SetBytes(b), nil
+	default:
+		return nil, fmt.Errorf("unsupported mmdb data type %d", typeNum)
+	}
+}
+
+func (d *mmdbDecoder) decodeControl(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errors.New("unexpected end of mmdb data")
+	}
+	ctrl := d.buf[offset]
+	offset++
+
+	typeNum := int(ctrl >> 5)
+	if typeNum == mmdbTypeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errors.New("unexpected end of mmdb data")
+		}
+		typeNum = int(d.buf[offset]) + 7
+		offset++
+	}
+
+	if typeNum == mmdbTypePointer {
+		// Pointers encode their own size; hand the raw control bits to decodePointer
+		return typeNum, uint(ctrl & 0x1f), offset, nil
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(d.buf)) {
+			return 0, 0, 0, errors.New("unexpected end of mmdb data")
+		}
+		var v uint
+		for _, c := range d.buf[offset : offset+extra] {
+			v = v<<8 | uint(c)
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+
+	return typeNum, size, offset, nil
+}
+
+func (d *mmdbDecoder) decodePointer(ctrl, offset uint) (uint, uint, error) {
+	pointerSize := ((ctrl >> 3) & 0x3) + 1
+	if offset+pointerSize > uint(len(d.buf)) {
+		return 0, 0, errors.New("unexpected end of mmdb data")
+	}
+	b := d.buf[offset : offset+pointerSize]
+
+	var prefix uint
+	if pointerSize != 4 {
+		prefix = ctrl & 0x7
+	}
+	v := prefix
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+
+	switch pointerSize {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+
+	return v, offset + pointerSize, nil
+}
+
+func minUint(a, b uint) uint {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func mmdbPath(record map[string]interface{}, keys ...string) interface{} {
+	var value interface{} = record
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+func mmdbString(value interface{}) string {
+	s, _ := value.(string)
+	return s
+}
+
+func mmdbUint(value interface{}) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case int32:
+		if v > 0 {
+			return uint64(v)
+		}
+	}
+	return 0
+}
+
+// parseASN accepts "AS13335", "as13335" or "13335"
+func parseASN(s string) uint32 {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(n)
+}
+
+// lookupMMDB resolves ip against the main database and merges ASN data from
+// the optional ASN database. It returns nil when no country is known.
+func lookupMMDB(reader, asnReader *mmdbReader, ip net.IP) *geoInfo {
+	info, err := reader.geoInfo(ip)
+	if err != nil || info == nil || info.Country == "" {
+		return nil
+	}
+
+	if asnReader != nil {
+		if asnInfo, err := asnReader.geoInfo(ip); err == nil && asnInfo != nil {
+			if asnInfo.ASN != 0 {
+				info.ASN = asnInfo.ASN
+			}
+			if asnInfo.Organization != "" {
+				info.Organization = asnInfo.Organization
+			}
+			// Both networks contain ip: the narrower one shares both answers
+			if asnOnes, _ := asnInfo.network.Mask.Size(); info.network != nil {
+				if ones, _ := info.network.Mask.Size(); asnOnes > ones {
+					info.network = asnInfo.network
+				}
+			}
+		}
+	}
+
+	return info
+}
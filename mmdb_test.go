@@ -0,0 +1,234 @@
+package traefik_geoblock_plugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbTestWriter produces minimal MaxMind DB files (IPv6 tree, 24-bit records) for tests
+type mmdbTestWriter struct {
+	nodes [][2]int64 // >= 0: child node, -1: empty, < -1: data offset encoded as -(offset+2)
+	data  []byte
+}
+
+func newMMDBTestWriter() *mmdbTestWriter {
+	return &mmdbTestWriter{nodes: [][2]int64{{-1, -1}}}
+}
+
+// insert maps network to the data section value at dataOffset
+func (w *mmdbTestWriter) insert(cidr string, dataOffset int) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ones, _ := network.Mask.Size()
+	ip := network.IP.To16()
+	if network.IP.To4() != nil {
+		// IPv4 networks live under ::/96 in an IPv6 tree
+		ip = make(net.IP, 16)
+		copy(ip[12:], network.IP.To4())
+		ones += 96
+	}
+
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if i == ones-1 {
+			w.nodes[node][bit] = -int64(dataOffset) - 2
+			return
+		}
+		if w.nodes[node][bit] < 0 {
+			w.nodes = append(w.nodes, [2]int64{-1, -1})
+			w.nodes[node][bit] = int64(len(w.nodes) - 1)
+		}
+		node = int(w.nodes[node][bit])
+	}
+}
+
+func (w *mmdbTestWriter) bytes() []byte {
+	nodeCount := len(w.nodes)
+	var out []byte
+	for _, node := range w.nodes {
+		for _, rec := range node {
+			var v int
+			switch {
+			case rec >= 0:
+				v = int(rec)
+			case rec == -1:
+				v = nodeCount
+			default:
+				v = nodeCount + mmdbDataSectionSeparator + int(-rec-2)
+			}
+			out = append(out, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	out = append(out, make([]byte, mmdbDataSectionSeparator)...)
+	out = append(out, w.data...)
+	out = append(out, mmdbMetadataMarker...)
+	out = append(out, mmdbEncodeMap(
+		"node_count", mmdbEncodeUint(mmdbTypeUint32, uint64(nodeCount)),
+		"record_size", mmdbEncodeUint(mmdbTypeUint16, 24),
+		"ip_version", mmdbEncodeUint(mmdbTypeUint16, 6),
+		"database_type", mmdbEncodeString("Test-Country"),
+	)...)
+	return out
+}
+
+// add appends an encoded value to the data section and returns its offset
+func (w *mmdbTestWriter) add(value []byte) int {
+	offset := len(w.data)
+	w.data = append(w.data, value...)
+	return offset
+}
+
+func mmdbEncodeControl(typeNum, size int) []byte {
+	var extra []byte
+	if size >= 29 {
+		// Sizes up to 284 only need the one-byte extension in these tests
+		extra = []byte{byte(size - 29)}
+		size = 29
+	}
+	if typeNum > 7 {
+		return append([]byte{byte(size), byte(typeNum - 7)}, extra...)
+	}
+	return append([]byte{byte(typeNum<<5 | size)}, extra...)
+}
+
+func mmdbEncodeString(s string) []byte {
+	return append(mmdbEncodeControl(mmdbTypeString, len(s)), s...)
+}
+
+func mmdbEncodeUint(typeNum int, v uint64) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append(mmdbEncodeControl(typeNum, len(b)), b...)
+}
+
+func mmdbEncodePointer(offset int) []byte {
+	return []byte{byte(mmdbTypePointer<<5 | (offset>>8)&0x7), byte(offset)}
+}
+
+// mmdbEncodeMap encodes alternating key (string) / encoded value arguments
+func mmdbEncodeMap(pairs ...interface{}) []byte {
+	out := mmdbEncodeControl(mmdbTypeMap, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, mmdbEncodeString(pairs[i].(string))...)
+		out = append(out, pairs[i+1].([]byte)...)
+	}
+	return out
+}
+
+func newTestMMDB(t *testing.T) []byte {
+	t.Helper()
+
+	w := newMMDBTestWriter()
+	usCountry := w.add(mmdbEncodeMap("iso_code", mmdbEncodeString("US")))
+	naContinent := w.add(mmdbEncodeMap("code", mmdbEncodeString("NA")))
+
+	us := w.add(mmdbEncodeMap(
+		"country", mmdbEncodePointer(usCountry),
+		"continent", mmdbEncodePointer(naContinent),
+		"autonomous_system_number", mmdbEncodeUint(mmdbTypeUint32, 15169),
+		"autonomous_system_organization", mmdbEncodeString("GOOGLE"),
+	))
+	de := w.add(mmdbEncodeMap(
+		"registered_country", mmdbEncodeMap("iso_code", mmdbEncodeString("de")),
+		"continent", mmdbEncodeMap("code", mmdbEncodeString("EU")),
+	))
+	ipinfo := w.add(mmdbEncodeMap(
+		"country_code", mmdbEncodeString("IT"),
+		"continent_code", mmdbEncodeString("EU"),
+		"asn", mmdbEncodeString("AS3269"),
+		"as_name", mmdbEncodeString("Telecom Italia"),
+	))
+
+	w.insert("8.8.8.0/24", us)
+	w.insert("2001:db8::/32", de)
+	w.insert("79.0.0.0/10", ipinfo)
+
+	return w.bytes()
+}
+
+func TestMMDBReaderLookup(t *testing.T) {
+	reader, err := newMMDBReader(newTestMMDB(t))
+	if err != nil {
+		t.Fatalf("Failed to open mmdb: %v", err)
+	}
+
+	if reader.databaseType != "Test-Country" {
+		t.Errorf("Expected database type Test-Country, got %s", reader.databaseType)
+	}
+
+	testCases := []struct {
+		ip       string
+		expected *geoInfo
+		network  string
+	}{
+		{"8.8.8.8", &geoInfo{Country: "US", Continent: "NA", ASN: 15169, Organization: "GOOGLE"}, "8.8.8.0/24"},
+		{"::ffff:8.8.8.8", &geoInfo{Country: "US", Continent: "NA", ASN: 15169, Organization: "GOOGLE"}, "8.8.8.0/24"},
+		{"2001:db8::1", &geoInfo{Country: "DE", Continent: "EU"}, "2001:db8::/32"},
+		{"79.20.1.1", &geoInfo{Country: "IT", Continent: "EU", ASN: 3269, Organization: "Telecom Italia"}, "79.0.0.0/10"},
+		{"8.8.9.9", nil, ""},
+		{"2001:db9::1", nil, ""},
+	}
+
+	for _, tc := range testCases {
+		info, err := reader.geoInfo(net.ParseIP(tc.ip))
+		if err != nil {
+			t.Errorf("geoInfo(%s) returned error: %v", tc.ip, err)
+			continue
+		}
+		if tc.expected == nil {
+			if info != nil {
+				t.Errorf("geoInfo(%s) = %+v, expected no match", tc.ip, info)
+			}
+			continue
+		}
+		if info != nil {
+			if info.network == nil || info.network.String() != tc.network {
+				t.Errorf("geoInfo(%s) matched network %v, expected %s", tc.ip, info.network, tc.network)
+			}
+			info.network = nil
+		}
+		if info == nil || *info != *tc.expected {
+			t.Errorf("geoInfo(%s) = %+v, expected %+v", tc.ip, info, tc.expected)
+		}
+	}
+}
+
+func TestMMDBReaderRejectsInvalidFiles(t *testing.T) {
+	if _, err := newMMDBReader([]byte("not a database")); err == nil {
+		t.Error("Expected error for file without metadata")
+	}
+
+	// Truncate the data section so the tree points outside the file
+	buf := newTestMMDB(t)
+	if _, err := newMMDBReader(buf[len(buf)-120:]); err == nil {
+		t.Error("Expected error for truncated file")
+	}
+}
+
+func TestLocalDatabaseMMDBFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, newTestMMDB(t), 0o600); err != nil {
+		t.Fatalf("Failed to write mmdb: %v", err)
+	}
+
+	g := &GeoBlock{localDB: &localDatabase{filePath: path, format: DatabaseFormatMMDB}}
+	if err := g.loadDatabaseFromFile(); err != nil {
+		t.Fatalf("Failed to load mmdb: %v", err)
+	}
+
+	info := g.lookupLocalDatabase("8.8.8.8")
+	if info == nil || info.Country != "US" || info.ASN != 15169 {
+		t.Errorf("Expected US/AS15169, got %+v", info)
+	}
+
+	if info := g.lookupLocalDatabase("1.1.1.1"); info != nil {
+		t.Errorf("Expected no match, got %+v", info)
+	}
+}
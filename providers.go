@@ -0,0 +1,522 @@
+package traefik_geoblock_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GeoIP provider chain
+
+const (
+	// ProviderLocalDB answers from the local database configured with databaseURL / databasePath
+	ProviderLocalDB = "localdb"
+	// ProviderHTTPJSON queries a JSON HTTP API such as ipapi.co, ipinfo.io or ip-api.com
+	ProviderHTTPJSON = "http-json"
+	// ProviderMMDB answers from a MaxMind DB file of its own
+	ProviderMMDB = "mmdb"
+	// ProviderStaticMap answers from a fixed list of IPs / CIDRs
+	ProviderStaticMap = "static-map"
+	// ProviderNone is the metrics label used when no provider answered
+	ProviderNone = "none"
+)
+
+// errAddressNotCovered is returned by providers that have no answer for an address
+var errAddressNotCovered = errors.New("address not covered")
+
+// ProviderConfig configures one entry of the providers chain
+type ProviderConfig struct {
+	Name    string            `json:"name,omitempty"`    // Label used in logs and metrics (default: the type)
+	Type    string            `json:"type,omitempty"`    // "localdb", "http-json", "mmdb" or "static-map"
+	URL     string            `json:"url,omitempty"`     // http-json: endpoint with an {ip} placeholder
+	Path    string            `json:"path,omitempty"`    // mmdb: database file
+	ASNPath string            `json:"asnPath,omitempty"` // mmdb: optional ASN database merged into lookups
+	Timeout string            `json:"timeout,omitempty"` // http-json: lookup timeout (default: httpTimeout)
+	Entries map[string]string `json:"entries,omitempty"` // static-map: IP or CIDR -> country code
+
+	CountryField      string `json:"countryField,omitempty"`      // http-json: dotted path to the country code
+	OrganizationField string `json:"organizationField,omitempty"` // http-json: dotted path to the organization
+	ASNField          string `json:"asnField,omitempty"`          // http-json: dotted path to the AS number
+	ContinentField    string `json:"continentField,omitempty"`    // http-json: dotted path to the continent code
+	ErrorField        string `json:"errorField,omitempty"`        // http-json: dotted path that marks a failed response
+	ErrorValue        string `json:"errorValue,omitempty"`        // http-json: value of errorField meaning failure (default: true)
+
+	Headers   map[string]string `json:"headers,omitempty"`   // http-json: request headers, values may use {token}
+	TokenFile string            `json:"tokenFile,omitempty"` // http-json: file holding the {token} value
+	TokenEnv  string            `json:"tokenEnv,omitempty"`  // http-json: environment variable holding the {token} value
+
+	RateLimit        int    `json:"rateLimit,omitempty"`        // http-json: lookups per minute allowed by the provider's quota (0: unlimited)
+	RateBurst        int    `json:"rateBurst,omitempty"`        // http-json: lookups allowed at once on top of the rate (default: rateLimit)
+	BreakerThreshold int    `json:"breakerThreshold,omitempty"` // http-json: consecutive failures that open the circuit breaker (default: 5, negative disables)
+	BreakerCooldown  string `json:"breakerCooldown,omitempty"`  // http-json: how long the breaker stays open before a probe (default: "30s")
+}
+
+// geoProvider resolves an address. Providers without an answer return errAddressNotCovered.
+type geoProvider interface {
+	lookup(ctx context.Context, ip net.IP) (*geoInfo, error)
+}
+
+// providerEntry is one configured step of the chain
+type providerEntry struct {
+	name     string
+	kind     string
+	timeout  time.Duration
+	provider geoProvider
+	limiter  *tokenBucket    // optional
+	breaker  *circuitBreaker // optional
+}
+
+// local reports whether the provider answers from a database rather than a remote API
+func (e *providerEntry) local() bool {
+	return e.kind != ProviderHTTPJSON
+}
+
+// lookup queries the provider within its timeout, unless its rate limit is
+// exhausted or its circuit breaker is open
+func (e *providerEntry) lookup(ip net.IP) (*geoInfo, error) {
+	if e.limiter != nil && !e.limiter.allow() {
+		return nil, errRateLimited
+	}
+	if e.breaker != nil && !e.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	ctx := context.Background()
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	info, err := e.provider.lookup(ctx, ip)
+
+	if e.breaker != nil {
+		e.breaker.record(err == nil || errors.Is(err, errAddressNotCovered))
+	}
+	return info, err
+}
+
+// buildProviders creates the chain from config.Providers, or from the legacy
+// options (local database, then queryURL) when no providers are configured
+func (g *GeoBlock) buildProviders(config *Config) ([]providerEntry, error) {
+	providerConfigs := config.Providers
+	if len(providerConfigs) == 0 {
+		providerConfigs = []ProviderConfig{{Type: ProviderLocalDB}}
+		if !config.OfflineMode {
+			providerConfigs = append(providerConfigs, queryProviderConfig(config))
+		}
+	}
+
+	entries := make([]providerEntry, 0, len(providerConfigs))
+	for _, providerConfig := range providerConfigs {
+		entry, err := g.newProvider(providerConfig, config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provider %q: %w", entry.name, err)
+		}
+		if entry.provider != nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// queryProviderConfig describes the legacy queryURL API as an http-json provider
+func queryProviderConfig(config *Config) ProviderConfig {
+	return ProviderConfig{
+		Type:              ProviderHTTPJSON,
+		URL:               config.QueryURL,
+		CountryField:      config.CountryField,
+		OrganizationField: config.OrganizationField,
+		ASNField:          config.ASNField,
+		ContinentField:    config.ContinentField,
+		ErrorField:        config.ErrorField,
+		ErrorValue:        config.ErrorValue,
+		Headers:           config.QueryHeaders,
+		TokenFile:         config.QueryTokenFile,
+		TokenEnv:          config.QueryTokenEnv,
+		RateLimit:         config.QueryRateLimit,
+		RateBurst:         config.QueryRateBurst,
+		BreakerThreshold:  config.QueryBreakerThreshold,
+		BreakerCooldown:   config.QueryBreakerCooldown,
+	}
+}
+
+func (g *GeoBlock) newProvider(providerConfig ProviderConfig, config *Config) (providerEntry, error) {
+	entry := providerEntry{name: providerConfig.Name, kind: strings.ToLower(providerConfig.Type)}
+	if entry.name == "" {
+		entry.name = entry.kind
+	}
+
+	if providerConfig.Timeout != "" {
+		// Local providers answer from memory and never wait on the context
+		if entry.kind != ProviderHTTPJSON {
+			return entry, errors.New("timeout is only supported by http-json providers")
+		}
+		timeout, err := time.ParseDuration(providerConfig.Timeout)
+		if err != nil || timeout <= 0 {
+			return entry, fmt.Errorf("invalid timeout %q", providerConfig.Timeout)
+		}
+		entry.timeout = timeout
+	}
+
+	switch entry.kind {
+	case ProviderLocalDB:
+		entry.provider = &localDBProvider{g: g}
+
+	case ProviderHTTPJSON:
+		if config.OfflineMode {
+			return entry, errors.New("http-json providers cannot be used in offlineMode")
+		}
+		if !strings.Contains(providerConfig.URL, "{ip}") {
+			return entry, errors.New("url must contain an {ip} placeholder")
+		}
+		client := g.httpClient
+		if client == nil {
+			client = &http.Client{Timeout: defaultHTTPTimeout}
+		}
+		if entry.timeout > 0 {
+			// Same transport and connection pool, own timeout
+			withTimeout := *client
+			withTimeout.Timeout = entry.timeout
+			client = &withTimeout
+		}
+		auth, err := newRequestAuth(providerConfig.Headers, providerConfig.TokenFile, providerConfig.TokenEnv, providerConfig.URL)
+		if err != nil {
+			return entry, err
+		}
+		if err := entry.guard(providerConfig); err != nil {
+			return entry, err
+		}
+		entry.provider = &httpJSONProvider{
+			url:       providerConfig.URL,
+			client:    client,
+			auth:      auth,
+			fields:    newResponseFields(providerConfig),
+			logMisses: config.LogBlocked,
+		}
+
+	case ProviderMMDB:
+		if providerConfig.Path == "" {
+			return entry, errors.New("path is required")
+		}
+		provider, err := newMMDBProvider(providerConfig.Path, providerConfig.ASNPath)
+		if err != nil {
+			// Like the local database, a missing file does not prevent startup
+			fmt.Printf("[GeoBlock] Warning: Provider %s disabled: %v\n", entry.name, err)
+			return entry, nil
+		}
+		entry.provider = provider
+
+	case ProviderStaticMap:
+		provider, err := newStaticMapProvider(providerConfig.Entries)
+		if err != nil {
+			return entry, err
+		}
+		entry.provider = provider
+
+	default:
+		return entry, fmt.Errorf("unsupported type %q", providerConfig.Type)
+	}
+
+	return entry, nil
+}
+
+// guard sets up the rate limiter and circuit breaker of a remote provider
+func (e *providerEntry) guard(providerConfig ProviderConfig) error {
+	if providerConfig.RateLimit < 0 || providerConfig.RateBurst < 0 {
+		return errors.New("rateLimit and rateBurst must not be negative")
+	}
+	if providerConfig.RateLimit > 0 {
+		e.limiter = newTokenBucket(providerConfig.RateLimit, providerConfig.RateBurst)
+	}
+
+	threshold := providerConfig.BreakerThreshold
+	if threshold < 0 {
+		return nil
+	}
+	if threshold == 0 {
+		threshold = defaultBreakerThreshold
+	}
+	cooldown := defaultBreakerCooldown
+	if providerConfig.BreakerCooldown != "" {
+		var err error
+		if cooldown, err = time.ParseDuration(providerConfig.BreakerCooldown); err != nil || cooldown <= 0 {
+			return fmt.Errorf("invalid breakerCooldown %q", providerConfig.BreakerCooldown)
+		}
+	}
+	e.breaker = newCircuitBreaker(e.name, threshold, cooldown)
+
+	return nil
+}
+
+// resolveGeoInfo asks each provider in order until one answers. When none
+// answers the country is unknown, unless a provider failed: then its error is
+// returned so the default action applies. The second result reports whether
+// the answer came from a local provider.
+func (g *GeoBlock) resolveGeoInfo(ip string) (*geoInfo, bool, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, false, fmt.Errorf("invalid IP address %q", ip)
+	}
+
+	var lastErr error
+	for i := range g.providers {
+		entry := &g.providers[i]
+
+		info, err := entry.lookup(parsedIP)
+		if err == nil {
+			info.Source = entry.name
+			g.recordLookup(entry.name)
+			return info, entry.local(), nil
+		}
+		if !errors.Is(err, errAddressNotCovered) {
+			lastErr = fmt.Errorf("provider %s: %w", entry.name, err)
+		}
+	}
+
+	g.recordLookup(ProviderNone)
+	if lastErr != nil {
+		return nil, false, lastErr
+	}
+	return &geoInfo{Country: CountryUnknown}, false, nil
+}
+
+// localDBProvider answers from the plugin's local database, whichever
+// generation is active at lookup time
+type localDBProvider struct {
+	g *GeoBlock
+}
+
+func (p *localDBProvider) lookup(_ context.Context, ip net.IP) (*geoInfo, error) {
+	if p.g.localDB == nil {
+		return nil, errAddressNotCovered
+	}
+	if info := p.g.localDB.current().lookup(ip); info != nil {
+		return info, nil
+	}
+	return nil, errAddressNotCovered
+}
+
+// mmdbProvider answers from a MaxMind DB file opened at startup
+type mmdbProvider struct {
+	reader    *mmdbReader
+	asnReader *mmdbReader
+}
+
+func newMMDBProvider(path, asnPath string) (*mmdbProvider, error) {
+	reader, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+	provider := &mmdbProvider{reader: reader}
+
+	if asnPath != "" {
+		if provider.asnReader, err = openMMDB(asnPath); err != nil {
+			return nil, fmt.Errorf("failed to load ASN database: %w", err)
+		}
+	}
+
+	return provider, nil
+}
+
+func (p *mmdbProvider) lookup(_ context.Context, ip net.IP) (*geoInfo, error) {
+	if info := lookupMMDB(p.reader, p.asnReader, ip); info != nil {
+		return info, nil
+	}
+	return nil, errAddressNotCovered
+}
+
+// staticMapProvider answers from a fixed IP / CIDR to country mapping
+type staticMapProvider struct {
+	index *rangeIndex
+}
+
+func newStaticMapProvider(entries map[string]string) (*staticMapProvider, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("entries are required")
+	}
+
+	builder := &rangeIndexBuilder{}
+	for key, country := range entries {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if country == "" {
+			return nil, fmt.Errorf("missing country for %q", key)
+		}
+
+		key = strings.TrimSpace(key)
+		if _, network, err := net.ParseCIDR(key); err == nil {
+			start, end := networkRange(network)
+			builder.add(start, end, geoRecord{country: country})
+			continue
+		}
+		ip := net.ParseIP(key)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", key)
+		}
+		builder.add(ip, ip, geoRecord{country: country})
+	}
+
+	return &staticMapProvider{index: builder.build()}, nil
+}
+
+func (p *staticMapProvider) lookup(_ context.Context, ip net.IP) (*geoInfo, error) {
+	record, network, ok := p.index.lookupNetwork(ip)
+	if !ok {
+		return nil, errAddressNotCovered
+	}
+	return &geoInfo{Country: record.country, network: network}, nil
+}
+
+// httpJSONProvider queries a GeoIP HTTP API returning JSON
+type httpJSONProvider struct {
+	url       string
+	client    *http.Client
+	auth      requestAuth
+	fields    responseFields
+	logMisses bool // log responses without a country (legacy logBlocked behaviour)
+}
+
+// responseFields are the dotted paths read from an http-json response. Each
+// value is taken from the first path present in the response.
+type responseFields struct {
+	country      []string
+	organization []string
+	asn          []string
+	continent    []string
+	errorField   string
+	errorValue   string
+}
+
+// newResponseFields uses the configured paths, falling back to the field names
+// of the common APIs (ipapi.co, ipinfo.io, ip-api.com)
+func newResponseFields(providerConfig ProviderConfig) responseFields {
+	paths := func(configured string, defaults ...string) []string {
+		if configured != "" {
+			return []string{configured}
+		}
+		return defaults
+	}
+
+	return responseFields{
+		country:      paths(providerConfig.CountryField, "country_code", "countryCode", "country"),
+		organization: paths(providerConfig.OrganizationField, "org", "isp", "asname", "as"),
+		asn:          paths(providerConfig.ASNField, "asn"),
+		continent:    paths(providerConfig.ContinentField, "continent_code", "continentCode"),
+		errorField:   providerConfig.ErrorField,
+		errorValue:   providerConfig.ErrorValue,
+	}
+}
+
+func (p *httpJSONProvider) lookup(ctx context.Context, ip net.IP) (*geoInfo, error) {
+	req, err := p.auth.newRequest(ctx, strings.Replace(p.url, "{ip}", ip.String(), 1))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query geo IP: %w", p.auth.redactError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("geo IP API returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var data interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	// Without errorValue only a true flag marks a failure, so status fields such
+	// as ip-api.com's "success"/"fail" need errorValue
+	if p.fields.errorField != "" {
+		failure := p.fields.errorValue
+		if failure == "" {
+			failure = "true"
+		}
+		if value, ok := jsonPath(data, p.fields.errorField); ok && value == failure {
+			return nil, fmt.Errorf("geo IP API reported an error (%s: %s)", p.fields.errorField, value)
+		}
+	}
+
+	country := firstJSONPath(data, p.fields.country)
+	if country == "" {
+		// Log the raw response for debugging
+		if p.logMisses {
+			fmt.Printf("[GeoBlock] Warning: Could not extract country from API response. Raw response: %s\n", string(body))
+		}
+		return nil, errAddressNotCovered
+	}
+
+	info := &geoInfo{
+		Country:      strings.ToUpper(country),
+		Organization: firstJSONPath(data, p.fields.organization),
+		Continent:    strings.ToUpper(firstJSONPath(data, p.fields.continent)),
+	}
+	// ASNs come as 15169, "15169", "AS15169" or "AS15169 Google LLC"
+	if asn := strings.Fields(firstJSONPath(data, p.fields.asn)); len(asn) > 0 {
+		info.ASN = parseASN(asn[0])
+	}
+
+	return info, nil
+}
+
+// firstJSONPath returns the first non-empty value found at paths
+func firstJSONPath(data interface{}, paths []string) string {
+	for _, path := range paths {
+		if value, ok := jsonPath(data, path); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// jsonPath resolves a dotted path such as "location.country.code" (numeric
+// segments index arrays) to a string, number or boolean value
+func jsonPath(data interface{}, path string) (string, bool) {
+	for _, segment := range strings.Split(path, ".") {
+		switch node := data.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return "", false
+			}
+			data = value
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			data = node[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch value := data.(type) {
+	case string:
+		return strings.TrimSpace(value), true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,285 @@
+package traefik_geoblock_plugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newProviderAPI serves fixed JSON for every IP and counts the requests
+func newProviderAPI(t *testing.T, status int, body string, delay time.Duration) (string, *int32) {
+	t.Helper()
+
+	hits := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		rw.WriteHeader(status)
+		_, _ = rw.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/{ip}", hits
+}
+
+func newProviderTestGeoBlock(t *testing.T, providers []ProviderConfig) *GeoBlock {
+	t.Helper()
+
+	config := CreateConfig()
+	config.Providers = providers
+	config.PrometheusMetricsPath = "/__geoblock_metrics"
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	return handler.(*GeoBlock)
+}
+
+func TestProviderChainFallback(t *testing.T) {
+	mmdbPath := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(mmdbPath, newTestMMDB(t), 0o600); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+
+	failingURL, failingHits := newProviderAPI(t, http.StatusTooManyRequests, "", 0)
+	emptyURL, _ := newProviderAPI(t, http.StatusOK, `{"error":true}`, 0)
+	apiURL, apiHits := newProviderAPI(t, http.StatusOK, `{"countryCode":"FR","isp":"Orange"}`, 0)
+
+	geoBlock := newProviderTestGeoBlock(t, []ProviderConfig{
+		{Type: ProviderStaticMap, Entries: map[string]string{"81.2.69.0/24": "it", "81.2.70.7": "CH"}},
+		{Name: "maxmind", Type: ProviderMMDB, Path: mmdbPath},
+		{Name: "ipinfo", Type: ProviderHTTPJSON, URL: failingURL},
+		{Name: "empty", Type: ProviderHTTPJSON, URL: emptyURL},
+		{Name: "ip-api", Type: ProviderHTTPJSON, URL: apiURL},
+	})
+
+	testCases := []struct {
+		ip      string
+		country string
+		source  string
+	}{
+		{ip: "81.2.69.9", country: "IT", source: ProviderStaticMap},
+		{ip: "81.2.70.7", country: "CH", source: ProviderStaticMap},
+		{ip: "8.8.8.8", country: "US", source: "maxmind"},
+		{ip: "1.1.1.1", country: "FR", source: "ip-api"},
+	}
+
+	for _, tc := range testCases {
+		info, err := geoBlock.getGeoInfo(tc.ip)
+		if err != nil {
+			t.Fatalf("getGeoInfo(%s) failed: %v", tc.ip, err)
+		}
+		if info.Country != tc.country || info.Source != tc.source {
+			t.Errorf("getGeoInfo(%s) = %s from %q, expected %s from %q", tc.ip, info.Country, info.Source, tc.country, tc.source)
+		}
+	}
+
+	if hits := atomic.LoadInt32(failingHits); hits != 1 {
+		t.Errorf("Expected only addresses missed by local providers to reach the API, got %d calls", hits)
+	}
+	if hits := atomic.LoadInt32(apiHits); hits != 1 {
+		t.Errorf("Expected 1 call to the last provider, got %d", hits)
+	}
+
+	metrics := geoBlock.promMetrics.render()
+	for _, line := range []string{
+		`traefik_geoblock_lookups_total{provider="static-map"} 2`,
+		`traefik_geoblock_lookups_total{provider="maxmind"} 1`,
+		`traefik_geoblock_lookups_total{provider="ip-api"} 1`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestProviderChainWithoutAnswer(t *testing.T) {
+	emptyURL, _ := newProviderAPI(t, http.StatusOK, `{}`, 0)
+	geoBlock := newProviderTestGeoBlock(t, []ProviderConfig{
+		{Type: ProviderHTTPJSON, URL: emptyURL},
+	})
+
+	info, err := geoBlock.getGeoInfo("1.1.1.1")
+	if err != nil || info.Country != CountryUnknown || info.Source != "" {
+		t.Errorf("Expected %s without source, got %+v (%v)", CountryUnknown, info, err)
+	}
+
+	// A failing provider is reported so the default action applies
+	failingURL, _ := newProviderAPI(t, http.StatusInternalServerError, "", 0)
+	geoBlock = newProviderTestGeoBlock(t, []ProviderConfig{
+		{Type: ProviderHTTPJSON, URL: emptyURL},
+		{Name: "broken", Type: ProviderHTTPJSON, URL: failingURL},
+	})
+
+	if _, err := geoBlock.getGeoInfo("1.1.1.1"); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Expected error naming the failed provider, got %v", err)
+	}
+	if !strings.Contains(geoBlock.promMetrics.render(), `traefik_geoblock_lookups_total{provider="none"} 1`) {
+		t.Error("Expected unanswered lookup to be counted")
+	}
+}
+
+func TestProviderTimeout(t *testing.T) {
+	slowURL, _ := newProviderAPI(t, http.StatusOK, `{"country_code":"US"}`, time.Second)
+	fastURL, _ := newProviderAPI(t, http.StatusOK, `{"country_code":"DE"}`, 0)
+
+	geoBlock := newProviderTestGeoBlock(t, []ProviderConfig{
+		{Name: "slow", Type: ProviderHTTPJSON, URL: slowURL, Timeout: "50ms"},
+		{Name: "fast", Type: ProviderHTTPJSON, URL: fastURL},
+	})
+
+	start := time.Now()
+	info, err := geoBlock.getGeoInfo("1.1.1.1")
+	if err != nil || info.Country != "DE" || info.Source != "fast" {
+		t.Errorf("Expected DE from the fast provider, got %+v (%v)", info, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the slow provider to be cut off, lookup took %v", elapsed)
+	}
+}
+
+func TestDefaultProviderChain(t *testing.T) {
+	config := CreateConfig()
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+
+	var kinds []string
+	for _, entry := range handler.(*GeoBlock).providers {
+		kinds = append(kinds, entry.kind)
+	}
+	if strings.Join(kinds, ",") != "localdb,http-json" {
+		t.Errorf("Expected legacy chain localdb,http-json, got %v", kinds)
+	}
+}
+
+func TestNewRejectsInvalidProviders(t *testing.T) {
+	testCases := map[string]ProviderConfig{
+		"unknown type":        {Type: "carrier-pigeon"},
+		"missing placeholder": {Type: ProviderHTTPJSON, URL: "https://ipapi.co/json/"},
+		"invalid timeout":     {Type: ProviderHTTPJSON, URL: "https://ipapi.co/{ip}/json/", Timeout: "soon"},
+		"localdb timeout":     {Type: ProviderLocalDB, Timeout: "1s"},
+		"static map timeout":  {Type: ProviderStaticMap, Entries: map[string]string{"81.2.69.0/24": "IT"}, Timeout: "1s"},
+		"mmdb without path":   {Type: ProviderMMDB},
+		"empty static map":    {Type: ProviderStaticMap},
+		"invalid static key":  {Type: ProviderStaticMap, Entries: map[string]string{"not-an-ip": "IT"}},
+	}
+
+	for name, provider := range testCases {
+		config := CreateConfig()
+		config.Providers = []ProviderConfig{provider}
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestHTTPJSONFieldMapping(t *testing.T) {
+	testCases := []struct {
+		name     string
+		body     string
+		provider ProviderConfig
+		expected geoInfo
+		err      bool
+		miss     bool
+	}{
+		{
+			name:     "legacy ip-api fields",
+			body:     `{"status":"success","countryCode":"it","isp":"Telecom Italia","as":"AS3269 Telecom Italia S.p.A."}`,
+			expected: geoInfo{Country: "IT", Organization: "Telecom Italia"},
+		},
+		{
+			name: "nested fields",
+			body: `{"location":{"country":{"code":"DE"},"continent":{"code":"eu"}},"connection":{"asn":3320,"organization":"Deutsche Telekom AG"}}`,
+			provider: ProviderConfig{
+				CountryField:      "location.country.code",
+				ContinentField:    "location.continent.code",
+				OrganizationField: "connection.organization",
+				ASNField:          "connection.asn",
+			},
+			expected: geoInfo{Country: "DE", Continent: "EU", Organization: "Deutsche Telekom AG", ASN: 3320},
+		},
+		{
+			name:     "array index and AS prefix",
+			body:     `{"results":[{"cc":"JP","as":"AS2497 Internet Initiative Japan"}]}`,
+			provider: ProviderConfig{CountryField: "results.0.cc", ASNField: "results.0.as"},
+			expected: geoInfo{Country: "JP", ASN: 2497},
+		},
+		{
+			name:     "ip-api failure",
+			body:     `{"status":"fail","message":"reserved range","countryCode":"US"}`,
+			provider: ProviderConfig{ErrorField: "status", ErrorValue: "fail"},
+			err:      true,
+		},
+		{
+			name:     "ip-api success with error field",
+			body:     `{"status":"success","countryCode":"US"}`,
+			provider: ProviderConfig{ErrorField: "status", ErrorValue: "fail"},
+			expected: geoInfo{Country: "US"},
+		},
+		{
+			name:     "ip-api success without error value",
+			body:     `{"status":"success","country":"United States","countryCode":"US","isp":"Google LLC","as":"AS15169 Google LLC"}`,
+			provider: ProviderConfig{ErrorField: "status"},
+			expected: geoInfo{Country: "US", Organization: "Google LLC"},
+		},
+		{
+			name:     "ipapi.co boolean error",
+			body:     `{"error":true,"reason":"RateLimited"}`,
+			provider: ProviderConfig{ErrorField: "error"},
+			err:      true,
+		},
+		{
+			name:     "error field false",
+			body:     `{"error":false,"country_code":"FR"}`,
+			provider: ProviderConfig{ErrorField: "error"},
+			expected: geoInfo{Country: "FR"},
+		},
+		{
+			name:     "mapped field missing",
+			body:     `{"country_code":"FR"}`,
+			provider: ProviderConfig{CountryField: "location.country.code"},
+			miss:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			url, _ := newProviderAPI(t, http.StatusOK, tc.body, 0)
+			provider := &httpJSONProvider{url: url, client: &http.Client{}, fields: newResponseFields(tc.provider)}
+
+			info, err := provider.lookup(context.Background(), net.ParseIP("1.1.1.1"))
+			switch {
+			case tc.err:
+				if err == nil || errors.Is(err, errAddressNotCovered) {
+					t.Errorf("Expected API error, got %+v (%v)", info, err)
+				}
+			case tc.miss:
+				if !errors.Is(err, errAddressNotCovered) {
+					t.Errorf("Expected miss, got %+v (%v)", info, err)
+				}
+			case err != nil:
+				t.Errorf("Unexpected error: %v", err)
+			case *info != tc.expected:
+				t.Errorf("Expected %+v, got %+v", tc.expected, *info)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package traefik_geoblock_plugin
+
+import (
+	"errors"
+	"sync"
+)
+
+// lookupGroup coalesces concurrent lookups of the same IP: while a lookup is
+// in flight, later callers wait for its result instead of starting their own.
+// It is a minimal in-package singleflight, as external modules are not
+// available to plugins.
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+// lookupCall is a lookup in flight or just completed
+type lookupCall struct {
+	done chan struct{} // closed once info and err are set
+	info *geoInfo
+	err  error
+}
+
+// do runs fn for key unless a call for key is already running, in which case
+// it waits for that call and returns its result. Every caller gets its own copy
+// of the answer.
+func (lg *lookupGroup) do(key string, fn func() (*geoInfo, error)) (*geoInfo, error) {
+	lg.mu.Lock()
+	if lg.calls == nil {
+		lg.calls = make(map[string]*lookupCall)
+	}
+	if call, ok := lg.calls[key]; ok {
+		lg.mu.Unlock()
+		<-call.done
+		return call.result()
+	}
+
+	call := &lookupCall{done: make(chan struct{})}
+	lg.calls[key] = call
+	lg.mu.Unlock()
+
+	defer func() {
+		lg.mu.Lock()
+		delete(lg.calls, key)
+		lg.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.info, call.err = fn()
+	return call.result()
+}
+
+func (c *lookupCall) result() (*geoInfo, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.info == nil {
+		// The leading call panicked
+		return nil, errors.New("lookup did not complete")
+	}
+	info := *c.info
+	return &info, nil
+}
@@ -0,0 +1,111 @@
+package traefik_geoblock_plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentMissesShareOneLookup(t *testing.T) {
+	var apiHits int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&apiHits, 1)
+		<-release
+		_, _ = rw.Write([]byte(`{"country_code":"FR"}`))
+	}))
+	defer server.Close()
+
+	config := CreateConfig()
+	config.QueryURL = server.URL + "/{ip}"
+	config.BlockedCountries = []string{"FR"}
+	config.LogBlocked = false
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}), config, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+
+	const requests = 100
+	var wg sync.WaitGroup
+	var blocked int32
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "1.2.3.4:12345"
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code == http.StatusForbidden {
+				atomic.AddInt32(&blocked, 1)
+			}
+		}()
+	}
+
+	// Hold the upstream answer until the first lookup arrives, so the burst overlaps it
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&apiHits) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if hits := atomic.LoadInt32(&apiHits); hits != 1 {
+		t.Errorf("Expected a single upstream lookup, got %d", hits)
+	}
+	if blocked != requests {
+		t.Errorf("Expected all %d requests to be blocked with the shared answer, got %d", requests, blocked)
+	}
+}
+
+func TestLookupGroup(t *testing.T) {
+	var group lookupGroup
+
+	// Waiters get their own copy of the shared answer
+	started, release := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([]*geoInfo, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = group.do("1.2.3.4", func() (*geoInfo, error) {
+			close(started)
+			<-release
+			return &geoInfo{Country: "IT"}, nil
+		})
+	}()
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[1], _ = group.do("1.2.3.4", func() (*geoInfo, error) {
+			t.Error("Expected the second caller to wait for the first lookup")
+			return nil, nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if results[0] == nil || results[1] == nil || results[0] == results[1] || *results[0] != *results[1] {
+		t.Errorf("Expected equal copies of the answer, got %+v and %+v", results[0], results[1])
+	}
+
+	// Errors are shared too, and a finished key starts a new lookup
+	lookupErr := errors.New("upstream down")
+	if _, err := group.do("1.2.3.4", func() (*geoInfo, error) { return nil, lookupErr }); !errors.Is(err, lookupErr) {
+		t.Errorf("Expected lookup error, got %v", err)
+	}
+	if len(group.calls) != 0 {
+		t.Errorf("Expected finished lookups to be forgotten, %d left", len(group.calls))
+	}
+}
@@ -0,0 +1,194 @@
+package traefik_geoblock_plugin
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// IANA special-purpose address registries (RFC 6890 and its updates)
+
+// Special-purpose address categories. The category is reported as the country
+// of matching addresses, in metrics, logs and downstream headers.
+const (
+	CategoryUnspecified   = "UNSPECIFIED"
+	CategoryPrivate       = "PRIVATE"
+	CategoryCGNAT         = "CGNAT"
+	CategoryLoopback      = "LOOPBACK"
+	CategoryLinkLocal     = "LINKLOCAL"
+	CategoryProtocol      = "PROTOCOL"
+	CategoryDocumentation = "DOCUMENTATION"
+	CategoryBenchmarking  = "BENCHMARKING"
+	CategoryMulticast     = "MULTICAST"
+	CategoryBroadcast     = "BROADCAST"
+	CategoryReserved      = "RESERVED"
+	CategoryNAT64         = "NAT64"
+	Category6to4          = "6TO4"
+	CategoryTeredo        = "TEREDO"
+)
+
+// Policies for special-purpose address categories
+const (
+	// SpecialPolicyCountry checks the category against allowedCountries and blockedCountries
+	SpecialPolicyCountry = "country"
+	// SpecialPolicyAllow lets the category through regardless of the country lists
+	SpecialPolicyAllow = "allow"
+	// SpecialPolicyBlock blocks the category regardless of the country lists
+	SpecialPolicyBlock = "block"
+	// SpecialPolicyGeolocate looks up the IPv4 address embedded in NAT64, 6TO4 and TEREDO addresses
+	SpecialPolicyGeolocate = "geolocate"
+)
+
+// legacyPrivateCategories were reported as PRIVATE before the registry was
+// split into categories. They still are, unless configVersion 2 is used or the
+// category is named in specialAddressPolicy.
+var legacyPrivateCategories = []string{CategoryCGNAT, CategoryLoopback, CategoryLinkLocal}
+
+// specialRange is one entry of the registry
+type specialRange struct {
+	network  *net.IPNet
+	category string                 // "" for globally reachable ranges inside a larger block
+	embedded func(ip net.IP) net.IP // IPv4 address carried by translation prefixes
+}
+
+// specialRanges is the registry, most specific ranges first
+var specialRanges = newSpecialRanges()
+
+func newSpecialRanges() []specialRange {
+	nat64 := func(ip net.IP) net.IP { return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4() }
+	// RFC 6052 /48 format: the address is split around the reserved octet 8
+	nat64Local := func(ip net.IP) net.IP { return net.IPv4(ip[6], ip[7], ip[9], ip[10]).To4() }
+	sixToFour := func(ip net.IP) net.IP { return net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4() }
+	// RFC 4380: the client address is stored with all bits inverted
+	teredo := func(ip net.IP) net.IP { return net.IPv4(^ip[12], ^ip[13], ^ip[14], ^ip[15]).To4() }
+
+	entries := []struct {
+		cidr     string
+		category string
+		embedded func(ip net.IP) net.IP
+	}{
+		{"0.0.0.0/8", CategoryUnspecified, nil},
+		{"10.0.0.0/8", CategoryPrivate, nil},
+		{"100.64.0.0/10", CategoryCGNAT, nil},
+		{"127.0.0.0/8", CategoryLoopback, nil},
+		{"169.254.0.0/16", CategoryLinkLocal, nil},
+		{"172.16.0.0/12", CategoryPrivate, nil},
+		{"192.0.0.0/24", CategoryProtocol, nil},
+		{"192.0.0.9/32", "", nil},  // Port Control Protocol anycast
+		{"192.0.0.10/32", "", nil}, // Traversal Using Relays around NAT anycast
+		{"192.0.2.0/24", CategoryDocumentation, nil},
+		{"192.88.99.0/24", CategoryReserved, nil}, // deprecated 6to4 relay anycast
+		{"192.168.0.0/16", CategoryPrivate, nil},
+		{"198.18.0.0/15", CategoryBenchmarking, nil},
+		{"198.51.100.0/24", CategoryDocumentation, nil},
+		{"203.0.113.0/24", CategoryDocumentation, nil},
+		{"224.0.0.0/4", CategoryMulticast, nil},
+		{"240.0.0.0/4", CategoryReserved, nil},
+		{"255.255.255.255/32", CategoryBroadcast, nil},
+
+		{"::/128", CategoryUnspecified, nil},
+		{"::1/128", CategoryLoopback, nil},
+		{"64:ff9b::/96", CategoryNAT64, nat64},
+		{"64:ff9b:1::/48", CategoryNAT64, nat64Local},
+		{"100::/64", CategoryReserved, nil}, // discard-only
+		{"2001::/23", CategoryProtocol, nil},
+		{"2001::/32", CategoryTeredo, teredo},
+		{"2001:1::1/128", "", nil}, // Port Control Protocol anycast
+		{"2001:1::2/128", "", nil}, // Traversal Using Relays around NAT anycast
+		{"2001:1::3/128", "", nil}, // DNS-SD service registration anycast
+		{"2001:2::/48", CategoryBenchmarking, nil},
+		{"2001:3::/32", "", nil},     // Automatic Multicast Tunneling
+		{"2001:4:112::/48", "", nil}, // AS112-v6
+		{"2001:20::/28", "", nil},    // ORCHIDv2
+		{"2001:30::/28", "", nil},    // Drone Remote ID Protocol entity tags
+		{"2001:db8::/32", CategoryDocumentation, nil},
+		{"2002::/16", Category6to4, sixToFour},
+		{"3fff::/20", CategoryDocumentation, nil},
+		{"5f00::/16", CategoryReserved, nil}, // segment routing SIDs
+		{"fc00::/7", CategoryPrivate, nil},
+		{"fe80::/10", CategoryLinkLocal, nil},
+		{"ff00::/8", CategoryMulticast, nil},
+	}
+
+	ranges := make([]specialRange, 0, len(entries))
+	for _, entry := range entries {
+		_, network, err := net.ParseCIDR(entry.cidr)
+		if err != nil {
+			continue
+		}
+		ranges = append(ranges, specialRange{network: network, category: entry.category, embedded: entry.embedded})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		onesI, _ := ranges[i].network.Mask.Size()
+		onesJ, _ := ranges[j].network.Mask.Size()
+		return onesI > onesJ
+	})
+	return ranges
+}
+
+// lookupSpecialRange returns the registry entry for ip, or nil when ip is a
+// globally reachable address
+func lookupSpecialRange(ip net.IP) *specialRange {
+	if ip == nil {
+		return nil
+	}
+	for i := range specialRanges {
+		if specialRanges[i].network.Contains(ip) {
+			if specialRanges[i].category == "" {
+				return nil
+			}
+			return &specialRanges[i]
+		}
+	}
+	return nil
+}
+
+// parseSpecialAddressPolicy resolves the policy of every category. Categories
+// carrying an IPv4 address are geolocated by default, the others are checked
+// against the country lists under their category name. It also returns the
+// categories reported under another name: without split, the legacy private
+// categories that are not configured are reported as PRIVATE.
+func parseSpecialAddressPolicy(configured map[string]string, split bool) (map[string]string, map[string]string, error) {
+	policies := make(map[string]string)
+	for _, r := range specialRanges {
+		switch {
+		case r.category == "":
+		case r.embedded != nil:
+			policies[r.category] = SpecialPolicyGeolocate
+		default:
+			policies[r.category] = SpecialPolicyCountry
+		}
+	}
+
+	named := make(map[string]bool)
+	for category, policy := range configured {
+		category = strings.ToUpper(strings.TrimSpace(category))
+		policy = strings.ToLower(strings.TrimSpace(policy))
+
+		current, ok := policies[category]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown specialAddressPolicy category %q", category)
+		}
+		switch policy {
+		case SpecialPolicyCountry, SpecialPolicyAllow, SpecialPolicyBlock:
+		case SpecialPolicyGeolocate:
+			if current != SpecialPolicyGeolocate {
+				return nil, nil, fmt.Errorf("specialAddressPolicy geolocate is only supported for %s, %s and %s, not %s", CategoryNAT64, Category6to4, CategoryTeredo, category)
+			}
+		default:
+			return nil, nil, fmt.Errorf("unsupported specialAddressPolicy %q for %s", policy, category)
+		}
+		policies[category] = policy
+		named[category] = true
+	}
+
+	aliases := make(map[string]string)
+	for _, category := range legacyPrivateCategories {
+		if !split && !named[category] {
+			aliases[category] = CategoryPrivate
+		}
+	}
+	return policies, aliases, nil
+}
@@ -0,0 +1,197 @@
+package traefik_geoblock_plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLookupSpecialRange(t *testing.T) {
+	testCases := []struct {
+		ip       string
+		category string
+	}{
+		{"0.1.2.3", CategoryUnspecified},
+		{"10.1.2.3", CategoryPrivate},
+		{"100.64.0.1", CategoryCGNAT},
+		{"100.128.0.1", ""},
+		{"127.0.0.1", CategoryLoopback},
+		{"169.254.169.254", CategoryLinkLocal},
+		{"172.31.255.255", CategoryPrivate},
+		{"172.32.0.1", ""},
+		{"192.0.0.8", CategoryProtocol},
+		{"192.0.0.9", ""},
+		{"192.0.2.1", CategoryDocumentation},
+		{"192.88.99.1", CategoryReserved},
+		{"198.19.255.255", CategoryBenchmarking},
+		{"203.0.113.5", CategoryDocumentation},
+		{"224.0.0.251", CategoryMulticast},
+		{"240.0.0.1", CategoryReserved},
+		{"255.255.255.255", CategoryBroadcast},
+		{"8.8.8.8", ""},
+		{"::", CategoryUnspecified},
+		{"::1", CategoryLoopback},
+		{"64:ff9b::8.8.8.8", CategoryNAT64},
+		{"64:ff9b:1::1", CategoryNAT64},
+		{"100::1", CategoryReserved},
+		{"2001::1", CategoryTeredo},
+		{"2001:1::1", ""},
+		{"2001:1::4", CategoryProtocol},
+		{"2001:2::1", CategoryBenchmarking},
+		{"2001:4:112::1", ""},
+		{"2001:db8::1", CategoryDocumentation},
+		{"2002:808:808::1", Category6to4},
+		{"3fff::1", CategoryDocumentation},
+		{"fd00::1", CategoryPrivate},
+		{"fe80::1", CategoryLinkLocal},
+		{"ff02::1", CategoryMulticast},
+		{"2606:4700::1111", ""},
+	}
+
+	for _, tc := range testCases {
+		category := ""
+		if special := lookupSpecialRange(net.ParseIP(tc.ip)); special != nil {
+			category = special.category
+		}
+		if category != tc.category {
+			t.Errorf("lookupSpecialRange(%s) = %q, expected %q", tc.ip, category, tc.category)
+		}
+	}
+}
+
+func TestSpecialRangeEmbeddedIPv4(t *testing.T) {
+	testCases := map[string]string{
+		"64:ff9b::5102:4505":                   "81.2.69.5",
+		"64:ff9b:1:5102:45:500::":              "81.2.69.5",
+		"2002:5102:4505::1":                    "81.2.69.5",
+		"2001:0:4136:e378:8000:63bf:aefd:bafa": "81.2.69.5",
+	}
+
+	for input, expected := range testCases {
+		ip := net.ParseIP(input)
+		special := lookupSpecialRange(ip)
+		if special == nil || special.embedded == nil {
+			t.Errorf("%s: expected a range with an embedded address", input)
+			continue
+		}
+		if got := special.embedded(ip).String(); got != expected {
+			t.Errorf("%s: embedded address %s, expected %s", input, got, expected)
+		}
+	}
+}
+
+func TestSpecialAddressPolicy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		policy   map[string]string
+		ip       string
+		status   int
+		expected string
+	}{
+		{"category checked against allowedCountries", nil, "192.168.1.1", http.StatusForbidden, `country="PRIVATE",action="blocked"`},
+		{"category in allowedCountries", map[string]string{"CGNAT": "country"}, "100.64.0.1", http.StatusOK, `country="CGNAT",action="allowed"`},
+		{"allow", map[string]string{"private": "allow"}, "192.168.1.1", http.StatusOK, `country="PRIVATE",action="allowed"`},
+		{"block", map[string]string{"CGNAT": "block"}, "100.64.0.1", http.StatusForbidden, `country="CGNAT",action="blocked"`},
+		{"CGNAT reported as PRIVATE by default", nil, "100.64.0.1", http.StatusForbidden, `country="PRIVATE",action="blocked"`},
+		{"NAT64 geolocated by default", nil, "64:ff9b::5102:4505", http.StatusOK, `country="IT",action="allowed"`},
+		{"6to4 geolocated by default", nil, "2002:5102:4505::1", http.StatusOK, `country="IT",action="allowed"`},
+		{"NAT64 of a private address", nil, "64:ff9b::10.1.2.3", http.StatusForbidden, `country="PRIVATE",action="blocked"`},
+		{"NAT64 as a category", map[string]string{"NAT64": "country"}, "64:ff9b::5102:4505", http.StatusForbidden, `country="NAT64",action="blocked"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.AllowedCountries = []string{"IT", "CGNAT"}
+			config.Providers = []ProviderConfig{{Type: ProviderStaticMap, Entries: map[string]string{"81.2.69.0/24": "IT"}}}
+			config.SpecialAddressPolicy = tc.policy
+			config.PrometheusMetricsPath = "/__geoblock_metrics"
+			config.LogBlocked = false
+
+			handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+			if err != nil {
+				t.Fatalf("Failed to create plugin: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			req.RemoteAddr = net.JoinHostPort(tc.ip, "1234")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			// Allowed requests reach the NotFound handler
+			status := rec.Code
+			if status == http.StatusNotFound {
+				status = http.StatusOK
+			}
+			if status != tc.status {
+				t.Errorf("Expected status %d, got %d", tc.status, rec.Code)
+			}
+
+			rec = httptest.NewRecorder()
+			handler.(*GeoBlock).servePrometheusMetrics(rec)
+			if !strings.Contains(rec.Body.String(), tc.expected) {
+				t.Errorf("Expected %s in metrics:\n%s", tc.expected, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestLegacyPrivateCategories(t *testing.T) {
+	testCases := []struct {
+		ip            string
+		configVersion int
+		status        int
+	}{
+		{"127.0.0.1", 0, http.StatusOK},
+		{"::1", 0, http.StatusOK},
+		{"169.254.169.254", ConfigVersionLegacy, http.StatusOK},
+		{"fe80::1", 0, http.StatusOK},
+		{"100.64.0.1", 0, http.StatusOK},
+		{"127.0.0.1", ConfigVersionCurrent, http.StatusForbidden},
+		{"100.64.0.1", ConfigVersionCurrent, http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		config := CreateConfig()
+		config.ConfigVersion = tc.configVersion
+		config.AllowedCountries = []string{"PRIVATE"}
+		config.LogBlocked = false
+
+		handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+		if err != nil {
+			t.Fatalf("Failed to create plugin: %v", err)
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		req.RemoteAddr = net.JoinHostPort(tc.ip, "1234")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		// Allowed requests reach the NotFound handler
+		status := rec.Code
+		if status == http.StatusNotFound {
+			status = http.StatusOK
+		}
+		if status != tc.status {
+			t.Errorf("%s with configVersion %d: expected status %d, got %d", tc.ip, tc.configVersion, tc.status, rec.Code)
+		}
+	}
+}
+
+func TestNewRejectsInvalidSpecialAddressPolicy(t *testing.T) {
+	for _, policy := range []map[string]string{
+		{"PUBLIC": "allow"},
+		{"PRIVATE": "ignore"},
+		{"PRIVATE": "geolocate"},
+	} {
+		config := CreateConfig()
+		config.SpecialAddressPolicy = policy
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+			t.Errorf("Expected error for specialAddressPolicy %v", policy)
+		}
+	}
+}